@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// AdminAPI - JSON API for operators on /admin, every request needs one of
+// Config.Admin.Tokens as a bearer token
+type AdminAPI struct {
+	tokens  []string
+	store   Store
+	redmine IssueTracker
+	handler *IssuesHandler
+}
+
+// NewAdminAPI ...
+func NewAdminAPI(config Config, store Store, redmine IssueTracker, handler *IssuesHandler) *AdminAPI {
+	return &AdminAPI{
+		tokens:  config.Admin.Tokens,
+		store:   store,
+		redmine: redmine,
+		handler: handler,
+	}
+}
+
+// Register adds the endpoints to the HTTP server, nothing is added without tokens
+func (api *AdminAPI) Register(e *echo.Echo) {
+	if len(api.tokens) == 0 {
+		return
+	}
+	g := e.Group("/admin", api.authenticate)
+	g.GET("/users", api.listUsers)
+	g.PATCH("/users/:id", api.updateUser)
+	g.GET("/deliveries", api.listDeliveries)
+	g.POST("/deliveries/:id/resend", api.resendDelivery)
+	g.GET("/events/failed", api.listFailedEvents)
+	g.POST("/events/:id/replay", api.replayEvent)
+	g.POST("/cache/flush", api.flushCache)
+}
+
+// authenticate checks the bearer token, the index of the token is logged
+// with the request so that actions can be traced to an operator
+func (api *AdminAPI) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header.Get(echo.HeaderAuthorization)
+		token := strings.TrimPrefix(header, "Bearer ")
+		for idx, allowed := range api.tokens {
+			if token != header && subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+				logger.Info("admin request", "method", c.Request().Method, "path", c.Request().URL.Path, "token_id", idx)
+				return next(c)
+			}
+		}
+		return adminError(c, http.StatusUnauthorized, "invalid token")
+	}
+}
+
+func adminError(c echo.Context, status int, message string) error {
+	return c.JSON(status, map[string]string{"error": message})
+}
+
+// storeError answers 404 for missing records and 500 otherwise
+func storeError(c echo.Context, err error) error {
+	if err == ErrNotFound {
+		return adminError(c, http.StatusNotFound, "not found")
+	}
+	logger.Error("admin request failed", "path", c.Request().URL.Path, "err", err)
+	return adminError(c, http.StatusInternalServerError, err.Error())
+}
+
+func pathID(c echo.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	return uint(id), err == nil
+}
+
+// queryLimit - "limit" query parameter, 50 by default and 500 at most
+func queryLimit(c echo.Context) int {
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit <= 0 {
+		return 50
+	}
+	if limit > 500 {
+		return 500
+	}
+	return limit
+}
+
+// adminUser - User as returned by the API
+type adminUser struct {
+	ID         uint      `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Phone      string    `json:"phone"`
+	Chat       int64     `json:"chat"`
+	TGUser     int       `json:"tg_user_id"`
+	IsAdmin    bool      `json:"is_admin"`
+	RedmineID  int       `json:"redmine_id"`
+	Language   string    `json:"language"`
+	ChatFailed bool      `json:"chat_failed"`
+	ChatError  string    `json:"chat_error,omitempty"`
+}
+
+func newAdminUser(user *User) adminUser {
+	return adminUser{
+		ID:         user.ID,
+		CreatedAt:  user.CreatedAt,
+		Phone:      user.Phone,
+		Chat:       user.Chat,
+		TGUser:     user.TGUser,
+		IsAdmin:    user.IsAdmin,
+		RedmineID:  user.RedmineID,
+		Language:   user.Language,
+		ChatFailed: user.ChatFailed,
+		ChatError:  user.ChatError,
+	}
+}
+
+// adminDelivery - notification of one recipient
+type adminDelivery struct {
+	ID          uint       `json:"id"`
+	IssueID     int        `json:"issue_id"`
+	JournalID   int        `json:"journal_id"`
+	TGUser      int        `json:"tg_user_id"`
+	Chat        int64      `json:"chat"`
+	ThreadID    int        `json:"thread_id,omitempty"`
+	Template    string     `json:"template"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	TGMessageID int        `json:"tg_message_id,omitempty"`
+	QueuedAt    time.Time  `json:"queued_at"`
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+	FailedAt    *time.Time `json:"failed_at,omitempty"`
+	EditedAt    *time.Time `json:"edited_at,omitempty"`
+}
+
+func newAdminDelivery(delivery *Delivery) adminDelivery {
+	return adminDelivery{
+		ID:          delivery.ID,
+		IssueID:     delivery.IssueID,
+		JournalID:   delivery.JournalID,
+		TGUser:      delivery.TGUser,
+		Chat:        delivery.Chat,
+		ThreadID:    delivery.ThreadID,
+		Template:    delivery.Template,
+		Status:      delivery.Status,
+		Error:       delivery.Error,
+		TGMessageID: delivery.TGMessageID,
+		QueuedAt:    delivery.QueuedAt,
+		SentAt:      delivery.SentAt,
+		FailedAt:    delivery.FailedAt,
+		EditedAt:    delivery.EditedAt,
+	}
+}
+
+// adminEvent - stored webhook event
+type adminEvent struct {
+	ID            uint      `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	IssueID       int       `json:"issue_id"`
+	Action        string    `json:"action"`
+	JournalID     int       `json:"journal_id"`
+	Source        string    `json:"source"`
+	CorrelationID string    `json:"correlation_id"`
+	Processed     bool      `json:"processed"`
+	Error         string    `json:"error"`
+}
+
+func newAdminEvent(event *WebhookEvent) adminEvent {
+	return adminEvent{
+		ID:            event.ID,
+		CreatedAt:     event.CreatedAt,
+		IssueID:       event.IssueID,
+		Action:        event.Action,
+		JournalID:     event.JournalID,
+		Source:        event.Source,
+		CorrelationID: event.CorrelationID,
+		Processed:     event.Processed,
+		Error:         event.Error,
+	}
+}
+
+// GET /admin/users?q=<phone part, chat or Telegram user id>&limit=
+func (api *AdminAPI) listUsers(c echo.Context) error {
+	users, err := api.store.SearchUsers(strings.TrimPrefix(c.QueryParam("q"), "+"), queryLimit(c))
+	if err != nil {
+		return storeError(c, err)
+	}
+	result := make([]adminUser, 0, len(users))
+	for _, user := range users {
+		result = append(result, newAdminUser(user))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// PATCH /admin/users/:id with {"is_admin": true, "redmine_id": 7}, omitted fields are kept
+func (api *AdminAPI) updateUser(c echo.Context) error {
+	id, ok := pathID(c)
+	if !ok {
+		return adminError(c, http.StatusBadRequest, "invalid id")
+	}
+	var body struct {
+		IsAdmin   *bool `json:"is_admin"`
+		RedmineID *int  `json:"redmine_id"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return adminError(c, http.StatusBadRequest, err.Error())
+	}
+	user, err := api.store.GetUser(id)
+	if err != nil {
+		return storeError(c, err)
+	}
+	isAdmin, redmineID := user.IsAdmin, user.RedmineID
+	if body.IsAdmin != nil {
+		isAdmin = *body.IsAdmin
+	}
+	if body.RedmineID != nil {
+		redmineID = *body.RedmineID
+	}
+	if err := api.store.UpdateUserRole(user, isAdmin, redmineID); err != nil {
+		return storeError(c, err)
+	}
+	logger.Info("user role changed", "user", user.ID, "is_admin", isAdmin, "redmine_id", redmineID)
+	user.IsAdmin, user.RedmineID = isAdmin, redmineID
+	return c.JSON(http.StatusOK, newAdminUser(user))
+}
+
+// GET /admin/deliveries?issue=<id>&user=<Telegram user id>&phone=<phone>&limit=,
+// the issue or a user is required
+func (api *AdminAPI) listDeliveries(c echo.Context) error {
+	issueID := 0
+	if value := c.QueryParam("issue"); value != "" {
+		var err error
+		if issueID, err = strconv.Atoi(strings.TrimPrefix(value, "#")); err != nil {
+			return adminError(c, http.StatusBadRequest, "invalid issue")
+		}
+	}
+	var tgUsers []int
+	if value := c.QueryParam("user"); value != "" {
+		tgUser, err := strconv.Atoi(value)
+		if err != nil {
+			return adminError(c, http.StatusBadRequest, "invalid user")
+		}
+		tgUsers = append(tgUsers, tgUser)
+	}
+	if phone := strings.TrimPrefix(c.QueryParam("phone"), "+"); phone != "" {
+		users, err := api.store.FindUsersByPhone([]string{phone})
+		if err != nil {
+			return storeError(c, err)
+		}
+		found := 0
+		for _, user := range users {
+			if user.TGUser != 0 {
+				tgUsers = append(tgUsers, user.TGUser)
+				found++
+			}
+		}
+		if found == 0 {
+			return c.JSON(http.StatusOK, []adminDelivery{})
+		}
+	}
+	if issueID == 0 && tgUsers == nil {
+		return adminError(c, http.StatusBadRequest, "issue, user or phone is required")
+	}
+	deliveries, err := api.store.GetDeliveries(issueID, tgUsers, queryLimit(c))
+	if err != nil {
+		return storeError(c, err)
+	}
+	result := make([]adminDelivery, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		result = append(result, newAdminDelivery(delivery))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// POST /admin/deliveries/:id/resend renders the notification again and sends
+// it to the same chat, ignoring quiet hours. The resend is a new delivery.
+func (api *AdminAPI) resendDelivery(c echo.Context) error {
+	id, ok := pathID(c)
+	if !ok {
+		return adminError(c, http.StatusBadRequest, "invalid id")
+	}
+	delivery, err := api.store.GetDelivery(id)
+	if err != nil {
+		return storeError(c, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ctx = withCorrelationID(ctx, newCorrelationID())
+	if err := api.handler.Resend(ctx, delivery); err == ErrNotFound {
+		return adminError(c, http.StatusUnprocessableEntity, "the recipient or the payload is gone")
+	} else if err != nil {
+		loggerFrom(ctx).Error("resend failed", "delivery", delivery.ID, "err", err)
+		return adminError(c, http.StatusBadGateway, err.Error())
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"resent": delivery.ID, "correlation_id": correlationID(ctx)})
+}
+
+// GET /admin/events/failed?limit= - the dead-letter queue, events whose
+// processing ended with an error
+func (api *AdminAPI) listFailedEvents(c echo.Context) error {
+	events, err := api.store.GetFailedWebhookEvents(queryLimit(c))
+	if err != nil {
+		return storeError(c, err)
+	}
+	result := make([]adminEvent, 0, len(events))
+	for _, event := range events {
+		result = append(result, newAdminEvent(event))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// POST /admin/events/:id/replay processes a stored webhook again
+func (api *AdminAPI) replayEvent(c echo.Context) error {
+	id, ok := pathID(c)
+	if !ok {
+		return adminError(c, http.StatusBadRequest, "invalid id")
+	}
+	if err := api.handler.Replay(c.Request().Context(), id); err != nil {
+		return storeError(c, err)
+	}
+	return c.JSON(http.StatusAccepted, map[string]uint{"replayed": id})
+}
+
+// POST /admin/cache/flush drops cached Redmine statuses, users, projects etc.
+func (api *AdminAPI) flushCache(c echo.Context) error {
+	flushed := api.redmine.FlushCache()
+	logger.Info("redmine cache flushed", "items", flushed)
+	return c.JSON(http.StatusOK, map[string]int{"flushed": flushed})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestAdminAuthenticate(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"first token", "Bearer first", http.StatusOK},
+		{"second token", "Bearer second", http.StatusOK},
+		{"wrong token", "Bearer third", http.StatusUnauthorized},
+		{"token prefix", "Bearer firs", http.StatusUnauthorized},
+		{"without scheme", "first", http.StatusUnauthorized},
+		{"empty bearer", "Bearer ", http.StatusUnauthorized},
+		{"no header", "", http.StatusUnauthorized},
+	}
+
+	var config Config
+	config.Admin.Tokens = []string{"first", "second"}
+	e := echo.New()
+	NewAdminAPI(config, newTestStore(t), nil, nil).Register(e)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+			if tt.header != "" {
+				req.Header.Set(echo.HeaderAuthorization, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminDisabledWithoutTokens(t *testing.T) {
+	e := echo.New()
+	NewAdminAPI(Config{}, newTestStore(t), nil, nil).Register(e)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer ")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"log"
+	"strings"
+	"time"
 
 	toml "github.com/BurntSushi/toml"
 )
@@ -14,18 +16,113 @@ type ProxyConfig struct {
 	Password string
 }
 
+// QuietHoursConfig - default quiet hours window, can be overridden per user
+type QuietHoursConfig struct {
+	Start            string
+	End              string
+	Timezone         string
+	UrgentPriorities []int
+}
+
+// RateLimitConfig - Telegram send limits
+type RateLimitConfig struct {
+	GlobalPerSecond float64
+	ChatPerSecond   float64
+	MaxRetries      int
+}
+
+// RedmineClientConfig - HTTP settings of Redmine API client
+type RedmineClientConfig struct {
+	Timeout    int // seconds
+	MaxRetries int
+	RetryDelay int // milliseconds, doubled after every retry
+}
+
+func (c RedmineClientConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 15 * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+func (c RedmineClientConfig) maxRetries() int {
+	if c.MaxRetries < 0 {
+		return 0
+	}
+	if c.MaxRetries == 0 {
+		return 3
+	}
+	return c.MaxRetries
+}
+
+func (c RedmineClientConfig) retryDelay() time.Duration {
+	if c.RetryDelay <= 0 {
+		return 500 * time.Millisecond
+	}
+	return time.Duration(c.RetryDelay) * time.Millisecond
+}
+
+// TelegramConfig - how updates are received: "polling" (default) or "webhook".
+// In webhook mode Telegram posts updates to WebhookURL, which must reach
+// WebhookPath of the bot's HTTP server.
+type TelegramConfig struct {
+	Mode        string
+	WebhookURL  string
+	WebhookPath string
+	SecretToken string // required, checked in X-Telegram-Bot-Api-Secret-Token
+	Certificate string // public key of a self-signed certificate, uploaded on registration
+}
+
+// PollingConfig - IssuePoller, a fallback for missed webhooks
+type PollingConfig struct {
+	Interval int // seconds, 0 disables polling
+}
+
+// HealthConfig - readiness thresholds of /readyz
+type HealthConfig struct {
+	MaxQueueDepth int // not ready with this many unprocessed events, 100 by default
+}
+
+// AdminConfig - operations API on /admin, disabled without tokens
+type AdminConfig struct {
+	Tokens []string // accepted in "Authorization: Bearer <token>"
+}
+
+// DashboardConfig - web page for dispatchers on /dashboard, disabled without a password
+type DashboardConfig struct {
+	Password string
+}
+
 type Config struct {
-	DbFile               string
-	WebhookHost          string
-	WebhookPort          int
-	TgToken              string
-	RedmineHost          string
-	RedmineAPIHost       string
-	RedmineToken         string
-	Debug                string
-	NotificationTemplate string
-	QueueSize            int
-	Proxy                ProxyConfig `toml:"Proxy"`
+	DbFile                     string
+	WebhookHost                string
+	WebhookPort                int
+	TgToken                    string
+	RedmineHost                string
+	RedmineAPIHost             string
+	RedmineToken               string
+	Debug                      string // deprecated, "true" is LogLevel = "debug"
+	LogLevel                   string // debug, info (default), warn or error
+	LogFormat                  string // logfmt (default) or json
+	NotificationTemplate       string
+	ClientNotificationTemplate string
+	TextFormatting             string
+	QueueSize                  int
+	UpdateWorkers              int
+	IssueWorkers               int
+	LongMessages               string
+	LocalesDir                 string
+	DefaultLanguage            string
+	Proxy                      ProxyConfig         `toml:"Proxy"`
+	QuietHours                 QuietHoursConfig    `toml:"QuietHours"`
+	RateLimit                  RateLimitConfig     `toml:"RateLimit"`
+	Redmine                    RedmineClientConfig `toml:"Redmine"`
+	Polling                    PollingConfig       `toml:"Polling"`
+	Telegram                   TelegramConfig      `toml:"Telegram"`
+	Health                     HealthConfig        `toml:"Health"`
+	Admin                      AdminConfig         `toml:"Admin"`
+	Dashboard                  DashboardConfig     `toml:"Dashboard"`
+	Rules                      []RoutingRule       `toml:"Rules"`
 }
 
 func parseConfig(configFile string) Config {
@@ -33,5 +130,45 @@ func parseConfig(configFile string) Config {
 	if _, err := toml.DecodeFile(configFile, &config); err != nil {
 		log.Panic(err)
 	}
+	if config.ClientNotificationTemplate == "" {
+		config.ClientNotificationTemplate = "./client_notification.tmpl"
+	}
+	if config.LocalesDir == "" {
+		config.LocalesDir = "./locales"
+	}
+	if config.DefaultLanguage == "" {
+		config.DefaultLanguage = "ru"
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+		if config.Debug == "true" {
+			config.LogLevel = "debug"
+		}
+	}
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		log.Panic(err)
+	}
+	if config.LogFormat == "" {
+		config.LogFormat = "logfmt"
+	}
+	if config.LogFormat != "logfmt" && config.LogFormat != "json" {
+		log.Panic("LogFormat must be logfmt or json")
+	}
+	if config.Telegram.Mode == "" {
+		config.Telegram.Mode = "polling"
+	}
+	if config.Telegram.WebhookPath == "" {
+		config.Telegram.WebhookPath = "/telegram"
+	}
+	if config.Telegram.Mode == "webhook" && config.Telegram.WebhookURL == "" {
+		log.Panic("Telegram.WebhookURL is required in webhook mode")
+	}
+	if config.Telegram.Mode == "webhook" && config.Telegram.SecretToken == "" {
+		log.Panic("Telegram.SecretToken is required in webhook mode")
+	}
 	return config
 }
+
+func (config Config) debug() bool {
+	return strings.EqualFold(config.LogLevel, "debug")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// parseConfigText writes text to a file and parses it, a panic is returned as ok = false
+func parseConfigText(t *testing.T, text string) (config Config, ok bool) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return parseConfig(path), true
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		ok   bool
+	}{
+		{"defaults", ``, true},
+		{"webhook mode", "[Telegram]\nMode = \"webhook\"\nWebhookURL = \"https://bot.example/telegram\"\nSecretToken = \"s3cret\"", true},
+		{"webhook mode without secret", "[Telegram]\nMode = \"webhook\"\nWebhookURL = \"https://bot.example/telegram\"", false},
+		{"webhook mode without URL", "[Telegram]\nMode = \"webhook\"\nSecretToken = \"s3cret\"", false},
+		{"unknown log level", `LogLevel = "verbose"`, false},
+		{"unknown log format", `LogFormat = "xml"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := parseConfigText(t, tt.text); ok != tt.ok {
+				t.Errorf("ok %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+
+	config, _ := parseConfigText(t, `Debug = "true"`)
+	if config.LogLevel != "debug" || config.Telegram.Mode != "polling" || config.DefaultLanguage != "ru" {
+		t.Errorf("defaults: level %q, mode %q, language %q", config.LogLevel, config.Telegram.Mode, config.DefaultLanguage)
+	}
+}
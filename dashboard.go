@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+//go:embed dashboard.html
+var dashboardHTML string
+
+const (
+	dashboardCookie  = "dashboard_session"
+	dashboardSession = 12 * time.Hour
+	dashboardRows    = 50
+)
+
+// Dashboard - server-rendered page for dispatchers on /dashboard: recent
+// webhooks, failed events, deliveries of notifications and users. It shows the data of
+// AdminAPI and replays and resends through it; dispatchers log in with
+// Config.Dashboard.Password.
+type Dashboard struct {
+	api      *AdminAPI
+	password string
+	i18n     *Translator
+	lang     string
+	page     *template.Template
+
+	mu       sync.Mutex
+	sessions map[string]time.Time // session id - expiry
+}
+
+// dashboardPage - data of dashboard.html
+type dashboardPage struct {
+	Lang       string
+	LoggedIn   bool
+	Notice     string
+	Error      string
+	Failed     []adminEvent
+	Events     []adminEvent
+	Deliveries []adminDelivery
+	Users      []adminUser
+}
+
+// NewDashboard ...
+func NewDashboard(config Config, api *AdminAPI, i18n *Translator) *Dashboard {
+	d := &Dashboard{
+		api:      api,
+		password: config.Dashboard.Password,
+		i18n:     i18n,
+		lang:     i18n.Language(config.DefaultLanguage),
+		sessions: make(map[string]time.Time),
+	}
+	d.page = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+		"t": func(key string, args ...interface{}) string {
+			return d.i18n.T(d.lang, key, args...)
+		},
+		"issueURL": func(id int) string {
+			return fmt.Sprintf("%sissues/%d", config.RedmineHost, id)
+		},
+	}).Parse(dashboardHTML))
+	return d
+}
+
+// Register adds the pages to the HTTP server, nothing is added without a password
+func (d *Dashboard) Register(e *echo.Echo) {
+	if d.password == "" {
+		return
+	}
+	e.GET("/dashboard", d.show)
+	e.POST("/dashboard/login", d.login)
+	e.POST("/dashboard/logout", d.logout)
+	// Not a group: echo adds catch-all routes for group middleware, they would hide GET /dashboard
+	e.POST("/dashboard/events/:id/replay", d.replayEvent, d.authenticate)
+	e.POST("/dashboard/deliveries/:id/resend", d.resendDelivery, d.authenticate)
+}
+
+func (d *Dashboard) loggedIn(c echo.Context) bool {
+	cookie, err := c.Cookie(dashboardCookie)
+	if err != nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	expiry, ok := d.sessions[cookie.Value]
+	if ok && time.Now().After(expiry) {
+		delete(d.sessions, cookie.Value)
+		return false
+	}
+	return ok
+}
+
+func (d *Dashboard) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !d.loggedIn(c) {
+			return c.Redirect(http.StatusSeeOther, "/dashboard")
+		}
+		return next(c)
+	}
+}
+
+func (d *Dashboard) login(c echo.Context) error {
+	if subtle.ConstantTimeCompare([]byte(c.FormValue("password")), []byte(d.password)) != 1 {
+		logger.Warn("dashboard login failed", "ip", c.RealIP())
+		return d.render(c, http.StatusUnauthorized, &dashboardPage{Error: d.i18n.T(d.lang, "dashboard.wrong_password")})
+	}
+	session := newCorrelationID() + newCorrelationID()
+	d.mu.Lock()
+	now := time.Now()
+	for id, expiry := range d.sessions {
+		if now.After(expiry) {
+			delete(d.sessions, id)
+		}
+	}
+	d.sessions[session] = now.Add(dashboardSession)
+	d.mu.Unlock()
+
+	logger.Info("dashboard login", "ip", c.RealIP())
+	c.SetCookie(&http.Cookie{
+		Name:     dashboardCookie,
+		Value:    session,
+		Path:     "/dashboard",
+		Expires:  now.Add(dashboardSession),
+		HttpOnly: true,
+		// Buttons are plain forms, a strict cookie is what keeps other sites from posting them
+		SameSite: http.SameSiteStrictMode,
+	})
+	return c.Redirect(http.StatusSeeOther, "/dashboard")
+}
+
+func (d *Dashboard) logout(c echo.Context) error {
+	if cookie, err := c.Cookie(dashboardCookie); err == nil {
+		d.mu.Lock()
+		delete(d.sessions, cookie.Value)
+		d.mu.Unlock()
+	}
+	c.SetCookie(&http.Cookie{Name: dashboardCookie, Path: "/dashboard", MaxAge: -1})
+	return c.Redirect(http.StatusSeeOther, "/dashboard")
+}
+
+func (d *Dashboard) render(c echo.Context, status int, page *dashboardPage) error {
+	page.Lang = d.lang
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().WriteHeader(status)
+	return d.page.Execute(c.Response(), page)
+}
+
+func (d *Dashboard) show(c echo.Context) error {
+	if !d.loggedIn(c) {
+		return d.render(c, http.StatusOK, &dashboardPage{})
+	}
+	page := &dashboardPage{
+		LoggedIn: true,
+		Notice:   c.QueryParam("notice"),
+		Error:    c.QueryParam("error"),
+	}
+	store := d.api.store
+
+	failed, err := store.GetFailedWebhookEvents(dashboardRows)
+	if err != nil {
+		return storeError(c, err)
+	}
+	for _, event := range failed {
+		page.Failed = append(page.Failed, newAdminEvent(event))
+	}
+	events, err := store.GetRecentWebhookEvents(dashboardRows)
+	if err != nil {
+		return storeError(c, err)
+	}
+	for _, event := range events {
+		page.Events = append(page.Events, newAdminEvent(event))
+	}
+	deliveries, err := store.GetDeliveries(0, nil, dashboardRows)
+	if err != nil {
+		return storeError(c, err)
+	}
+	for _, delivery := range deliveries {
+		page.Deliveries = append(page.Deliveries, newAdminDelivery(delivery))
+	}
+	users, err := store.SearchUsers("", 500)
+	if err != nil {
+		return storeError(c, err)
+	}
+	for _, user := range users {
+		page.Users = append(page.Users, newAdminUser(user))
+	}
+	return d.render(c, http.StatusOK, page)
+}
+
+// done redirects back to the page with the outcome of a button
+func (d *Dashboard) done(c echo.Context, key string, id string, err error) error {
+	query := url.Values{}
+	if err != nil {
+		query.Set("error", d.i18n.T(d.lang, "dashboard.action_failed", err.Error()))
+	} else {
+		query.Set("notice", d.i18n.T(d.lang, key, id))
+	}
+	return c.Redirect(http.StatusSeeOther, "/dashboard?"+query.Encode())
+}
+
+func (d *Dashboard) replayEvent(c echo.Context) error {
+	id, ok := pathID(c)
+	if !ok {
+		return d.done(c, "", "", fmt.Errorf("invalid id %q", c.Param("id")))
+	}
+	err := d.api.handler.Replay(c.Request().Context(), id)
+	return d.done(c, "dashboard.replayed", c.Param("id"), err)
+}
+
+func (d *Dashboard) resendDelivery(c echo.Context) error {
+	id, ok := pathID(c)
+	if !ok {
+		return d.done(c, "", "", fmt.Errorf("invalid id %q", c.Param("id")))
+	}
+	delivery, err := d.api.store.GetDelivery(id)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		ctx = withCorrelationID(ctx, newCorrelationID())
+		if err = d.api.handler.Resend(ctx, delivery); err != nil {
+			loggerFrom(ctx).Error("resend failed", "delivery", delivery.ID, "err", err)
+		}
+	}
+	return d.done(c, "dashboard.resent", c.Param("id"), err)
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"log"
 	// "fmt"
 	// "reflect"
-	"sync"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
@@ -13,88 +12,179 @@ import (
 type User struct {
 	gorm.Model
 	Phone        string `gorm:"column:phone"`
-	Chat         int64  `gorm:"unique,column:chat"`
-	TGUser       int  `gorm:"unique,column:tg_user_id"`
+	Chat         int64  `gorm:"column:chat"`       // unique, see fixUserConstraints
+	TGUser       int    `gorm:"column:tg_user_id"` // unique if not 0
 	IsAdmin      bool   `gorm:"column:is_admin"`
 	RedmineID    int    `gorm:"column:redmine_id"`
-	Issues       bool   `gorm:"column:uniqie,column:issue"`
+	Issues       bool   `gorm:"column:issue"`
 	CurrentIssue int    `gorm:"column:current_issue_id"`
+	QuietStart   string `gorm:"column:quiet_start"`
+	QuietEnd     string `gorm:"column:quiet_end"`
+	Timezone     string `gorm:"column:timezone"`
+	ChatFailed   bool   `gorm:"column:chat_failed"`
+	ChatError    string `gorm:"column:chat_error"`
+	Language     string `gorm:"column:language"`
 }
 
+// Message - payload of a notification sent to a user, kept for resends and
+// previews. The outcome is in Delivery, status_send and apply_status_send
+// columns of older versions are left in the table unused.
 type Message struct {
 	gorm.Model
-	TGUser             int  `gorm:"column:tg_user_id"`
-	Status 		       string `gorm:"column:status"`
-	Subject		       string `gorm:"column:subject"`
-	Phone              string `gorm:"column:phone"`
-	IsAdmin			   bool   `gorm:"column:is_admin"`
-	SendStatus   	   bool   `gorm:"column:status_send"`
-	ApplySendStatus    bool   `gorm:"column:apply_status_send"`
-	JSONMessage		   string `gorm:"column:json_message"`
+	TGUser      int    `gorm:"column:tg_user_id"`
+	IssueID     int    `gorm:"column:issue_id;index"`
+	Status      string `gorm:"column:status"`
+	Subject     string `gorm:"column:subject"`
+	Phone       string `gorm:"column:phone"`
+	IsAdmin     bool   `gorm:"column:is_admin"`
+	JSONMessage string `gorm:"column:json_message"`
+}
+
+// OutboundMessage - notification held back until the recipient's quiet hours end
+type OutboundMessage struct {
+	gorm.Model
+	Chat        int64     `gorm:"column:chat;index"`
+	ThreadID    int       `gorm:"column:thread_id"`
+	IssueID     int       `gorm:"column:issue_id;index"`
+	Text        string    `gorm:"column:text"`
+	ParseMode   string    `gorm:"column:parse_mode"`
+	ReplyMarkup string    `gorm:"column:reply_markup"`
+	Language    string    `gorm:"column:language"` // of the recipient, for buttons added on send
+	DeliverAt   time.Time `gorm:"column:deliver_at;index"`
+	Delivered   bool      `gorm:"column:delivered"` // sent or dropped after a failure
+}
+
+// Delivery - notification of one recipient about one issue change. It is
+// queued before the send and ends up sent, deferred until quiet hours end,
+// failed or unavailable (the chat blocked the bot).
+type Delivery struct {
+	gorm.Model
+	IssueID     int        `gorm:"column:issue_id;index"`
+	JournalID   int        `gorm:"column:journal_id"`
+	TGUser      int        `gorm:"column:tg_user_id;index"` // 0 for group chats
+	Chat        int64      `gorm:"column:chat;index"`
+	ThreadID    int        `gorm:"column:thread_id"`
+	Template    string     `gorm:"column:template"`
+	MessageID   uint       `gorm:"column:message_id"`        // Message with the payload
+	OutboundID  uint       `gorm:"column:outbound_id;index"` // OutboundMessage of a deferred delivery
+	TGMessageID int        `gorm:"column:tg_message_id"`     // last part if the text was split
+	Status      string     `gorm:"column:status"`
+	Error       string     `gorm:"column:error"`
+	QueuedAt    time.Time  `gorm:"column:queued_at"`
+	SentAt      *time.Time `gorm:"column:sent_at"`
+	FailedAt    *time.Time `gorm:"column:failed_at"`
+	EditedAt    *time.Time `gorm:"column:edited_at"` // the bot doesn't edit notifications yet
+}
+
+// LongMessage - full text of a truncated notification, sent on "show full" request
+type LongMessage struct {
+	gorm.Model
+	Chat      int64  `gorm:"column:chat"`
+	ThreadID  int    `gorm:"column:thread_id"`
+	Text      string `gorm:"column:text"`
+	ParseMode string `gorm:"column:parse_mode"`
+}
+
+// WebhookEvent - Redmine webhook payload, stored before the webhook is acknowledged,
+// or an event synthesized by IssuePoller. Action and JournalID identify the change
+// for deduplication, Source is "webhook" or "poller".
+type WebhookEvent struct {
+	gorm.Model
+	IssueID       int    `gorm:"column:issue_id;index"`
+	Action        string `gorm:"column:action"`
+	JournalID     int    `gorm:"column:journal_id"`
+	Source        string `gorm:"column:source"`
+	CorrelationID string `gorm:"column:correlation_id"` // ties log records of the event together
+	Payload       string `gorm:"column:payload"`
+	Processed     bool   `gorm:"column:processed;index"`
+	Error         string `gorm:"column:error"`
+}
+
+// Checkpoint - position of a background job, e.g. the last seen updated_on of IssuePoller
+type Checkpoint struct {
+	gorm.Model
+	Name  string    `gorm:"column:name;unique_index"`
+	Value time.Time `gorm:"column:value"`
+}
+
+// GroupChat - group or channel registered by an admin to receive notifications
+type GroupChat struct {
+	gorm.Model
+	Chat     int64  `gorm:"column:chat;unique_index"`
+	Title    string `gorm:"column:title"`
+	Type     string `gorm:"column:type"`
+	Language string `gorm:"column:language"`
+	// ChatFailed - the bot was removed from the group, notifications are not sent
+	ChatFailed bool   `gorm:"column:chat_failed"`
+	ChatError  string `gorm:"column:chat_error"`
+}
+
+// ChatBinding - notifications of a project, tracker or assignee go to the chat
+// or its forum topic. Zero fields match any issue.
+type ChatBinding struct {
+	gorm.Model
+	Chat       int64 `gorm:"column:chat;index"`
+	ThreadID   int   `gorm:"column:thread_id"`
+	ProjectID  int   `gorm:"column:project_id"`
+	TrackerID  int   `gorm:"column:tracker_id"`
+	AssigneeID int   `gorm:"column:assignee_id"`
 }
 
 func NewDBInstance(dbFile string) *gorm.DB {
 	db, err := gorm.Open("sqlite3", dbFile)
 	if err != nil {
-		log.Panic(err)
+		logger.Fatal("database open failed", "file", dbFile, "err", err)
 	}
 	return db
 }
 
-func ProcessMigrations(db *gorm.DB) {
-	db.AutoMigrate(&User{})
-	db.AutoMigrate(&Message{})
-}
-
 func FindUsersByPhone(db *gorm.DB, phones []string) (users []*User, err error) {
 	err = db.Where("phone IN (?)", phones).Find(&users).Error
 	return users, err
 }
 
-func GetOrCreateUser(db *gorm.DB, chatID int64, userID int, phone string) (user *User, err error) {
+// GetOrCreateUser registers the chat, a registered chat that shares another
+// contact keeps its settings and gets the new phone
+func GetOrCreateUser(db *gorm.DB, chatID int64, userID int, phone string, language string) (user *User, err error) {
 	user = new(User)
-	err = db.Where(User{Chat: chatID, Phone: phone}).Last(user).Error
+	err = db.Where(User{Chat: chatID}).First(user).Error
 	if err == gorm.ErrRecordNotFound {
 		user = &User{
-			Chat:    chatID,
-			TGUser:  userID,
-			Phone:   phone,
-			IsAdmin: false,
+			Chat:     chatID,
+			TGUser:   userID,
+			Phone:    phone,
+			IsAdmin:  false,
+			Language: language,
 		}
-		db.Create(user)
-		return user, nil
+		return user, db.Create(user).Error
+	}
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	if user.Phone != phone || user.TGUser != userID {
+		err = db.Model(user).Updates(map[string]interface{}{
+			"phone":      phone,
+			"tg_user_id": userID,
+		}).Error
+	}
+	return user, err
 }
 
-func GetOrCreateMessage(db *gorm.DB, userID int, status string, subject string, phone string, isAdmin bool,send_status bool,json_message string) (message *Message, err error) {
-	// mu := &sync.Mutex{}
-	// globalLock.Lock()
-	// defer globalLock.Unlock()
-	// // rows, err := db.Begin()
-	// if err != nil {
-	// 	fmt.Printf("begin. Exec error=%s", err)
-	// 	return
-	// }
-	message = new(Message)
-	// defer rows.Commit()
-	// err = db.Where(Message{TGUser: userID, Phone: phone}).Last(message).Error
-	// if err == gorm.ErrRecordNotFound {
+func GetOrCreateMessage(db *gorm.DB, userID int, issueID int, status string, subject string, phone string, isAdmin bool, jsonMessage string) (message *Message, err error) {
 	message = &Message{
-		TGUser: userID,
-		Status: status,
-		Subject: subject,
-		Phone: phone,
-		IsAdmin: isAdmin,
-		SendStatus: send_status,
-		ApplySendStatus: false,
-		JSONMessage: json_message,
-	}
-	db.Create(message)
-	log.Println("Create New Message")
+		TGUser:      userID,
+		IssueID:     issueID,
+		Status:      status,
+		Subject:     subject,
+		Phone:       phone,
+		IsAdmin:     isAdmin,
+		JSONMessage: jsonMessage,
+	}
+	if err := db.Create(message).Error; err != nil {
+		return nil, err
+	}
+	logger.Debug("message created", "message", message.ID, "tg_user", userID)
 	return message, nil
-	// }
-	// return nil, err
 }
 
 func GetAdmins(db *gorm.DB) (admins []*User, err error) {
@@ -102,11 +192,26 @@ func GetAdmins(db *gorm.DB) (admins []*User, err error) {
 	return admins, err
 }
 
+func GetUsersByRedmineIDs(db *gorm.DB, ids []int) (users []*User, err error) {
+	err = db.Where("redmine_id IN (?)", ids).Find(&users).Error
+	return users, err
+}
+
 func GetUserByChatID(db *gorm.DB, chat int64) (user *User, err error) {
+	user = new(User)
 	err = db.Where(User{Chat: chat}).First(user).Error
 	return user, err
 }
 
+func GetUserByTGUser(db *gorm.DB, userID int) (user *User, err error) {
+	user = new(User)
+	if userID == 0 {
+		return user, gorm.ErrRecordNotFound
+	}
+	err = db.Where(User{TGUser: userID}).First(user).Error
+	return user, err
+}
+
 func GetIssues(db *gorm.DB) (issues []*User, err error) {
 	err = db.Where(User{Issues: true}).Find(&issues).Error
 	return issues, err
@@ -117,11 +222,270 @@ func GetCurrentIssueID(db *gorm.DB, current_issue_id int) (issue *User, err erro
 	return issue, err
 }
 
-func UpdateApplySendStatus(db *gorm.DB, message Message) (msg *Message, err error) {
-	globalLock := &sync.Mutex{}
-	globalLock.Lock()
-	defer globalLock.Unlock()
-	message.ApplySendStatus = true
-	db.Save(message)
-	return msg, nil
-}
\ No newline at end of file
+func UpdateUserQuietHours(db *gorm.DB, user *User, start string, end string, timezone string) error {
+	return db.Model(user).Updates(map[string]interface{}{
+		"quiet_start": start,
+		"quiet_end":   end,
+		"timezone":    timezone,
+	}).Error
+}
+
+// GetPendingOutbound - undelivered message for the chat and issue, if any
+func GetPendingOutbound(db *gorm.DB, chat int64, threadID int, issueID int, parseMode string) (message *OutboundMessage, err error) {
+	message = new(OutboundMessage)
+	err = db.Where("chat = ? AND thread_id = ? AND issue_id = ? AND parse_mode = ? AND delivered = ?", chat, threadID, issueID, parseMode, false).Last(message).Error
+	return message, err
+}
+
+func GetDueOutbound(db *gorm.DB, now time.Time) (messages []*OutboundMessage, err error) {
+	err = db.Where("delivered = ? AND deliver_at <= ?", false, now).Order("deliver_at").Find(&messages).Error
+	return messages, err
+}
+
+func SaveOutbound(db *gorm.DB, message *OutboundMessage) error {
+	return db.Save(message).Error
+}
+
+func MarkOutboundDelivered(db *gorm.DB, message *OutboundMessage) error {
+	return db.Model(message).Update("delivered", true).Error
+}
+
+// MarkChatUnavailable - bot was blocked or the chat is gone
+func MarkChatUnavailable(db *gorm.DB, chat int64, reason string) error {
+	fields := map[string]interface{}{
+		"chat_failed": true,
+		"chat_error":  reason,
+	}
+	if err := db.Model(&User{}).Where("chat = ?", chat).Updates(fields).Error; err != nil {
+		return err
+	}
+	return db.Model(&GroupChat{}).Where("chat = ?", chat).Updates(fields).Error
+}
+
+func ResetChatUnavailable(db *gorm.DB, chat int64) error {
+	fields := map[string]interface{}{
+		"chat_failed": false,
+		"chat_error":  "",
+	}
+	if err := db.Model(&User{}).Where("chat = ? AND chat_failed = ?", chat, true).Updates(fields).Error; err != nil {
+		return err
+	}
+	return db.Model(&GroupChat{}).Where("chat = ? AND chat_failed = ?", chat, true).Updates(fields).Error
+}
+
+func CreateLongMessage(db *gorm.DB, chat int64, threadID int, text string, parseMode string) (message *LongMessage, err error) {
+	message = &LongMessage{
+		Chat:      chat,
+		ThreadID:  threadID,
+		Text:      text,
+		ParseMode: parseMode,
+	}
+	err = db.Create(message).Error
+	return message, err
+}
+
+func GetLongMessage(db *gorm.DB, id int) (message *LongMessage, err error) {
+	message = new(LongMessage)
+	err = db.First(message, id).Error
+	return message, err
+}
+
+func UpdateUserLanguage(db *gorm.DB, user *User, language string) error {
+	return db.Model(user).Update("language", language).Error
+}
+
+func CreateWebhookEvent(db *gorm.DB, issueID int, action string, journalID int, source string, correlationID string, payload string) (event *WebhookEvent, err error) {
+	event = &WebhookEvent{
+		IssueID:       issueID,
+		Action:        action,
+		JournalID:     journalID,
+		Source:        source,
+		CorrelationID: correlationID,
+		Payload:       payload,
+	}
+	err = db.Create(event).Error
+	return event, err
+}
+
+func FindWebhookEvent(db *gorm.DB, issueID int, action string, journalID int) (event *WebhookEvent, err error) {
+	event = new(WebhookEvent)
+	err = db.Where("issue_id = ? AND action = ? AND journal_id = ?", issueID, action, journalID).First(event).Error
+	return event, err
+}
+
+func GetWebhookEvent(db *gorm.DB, id uint) (event *WebhookEvent, err error) {
+	event = new(WebhookEvent)
+	err = db.First(event, id).Error
+	return event, err
+}
+
+// GetPendingWebhookEvents - events not processed yet, oldest first
+func GetPendingWebhookEvents(db *gorm.DB) (events []*WebhookEvent, err error) {
+	err = db.Where("processed = ?", false).Order("id").Find(&events).Error
+	return events, err
+}
+
+func CountPendingWebhookEvents(db *gorm.DB) (count int, err error) {
+	err = db.Model(&WebhookEvent{}).Where("processed = ?", false).Count(&count).Error
+	return count, err
+}
+
+func MarkWebhookEventProcessed(db *gorm.DB, event *WebhookEvent, reason string) error {
+	return db.Model(event).Updates(map[string]interface{}{
+		"processed": true,
+		"error":     reason,
+	}).Error
+}
+
+func RegisterGroupChat(db *gorm.DB, chat int64, title string, chatType string, language string) (group *GroupChat, err error) {
+	group = new(GroupChat)
+	err = db.Where(GroupChat{Chat: chat}).First(group).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	group.Chat = chat
+	group.Title = title
+	group.Type = chatType
+	// The bot is back in the group
+	group.ChatFailed = false
+	group.ChatError = ""
+	if group.Language == "" {
+		group.Language = language
+	}
+	err = db.Save(group).Error
+	return group, err
+}
+
+func GetGroupChat(db *gorm.DB, chat int64) (group *GroupChat, err error) {
+	group = new(GroupChat)
+	err = db.Where(GroupChat{Chat: chat}).First(group).Error
+	return group, err
+}
+
+func CreateChatBinding(db *gorm.DB, binding *ChatBinding) error {
+	return db.Create(binding).Error
+}
+
+func GetChatBindings(db *gorm.DB) (bindings []*ChatBinding, err error) {
+	err = db.Order("id").Find(&bindings).Error
+	return bindings, err
+}
+
+func GetChatBindingsByChat(db *gorm.DB, chat int64, threadID int) (bindings []*ChatBinding, err error) {
+	err = db.Where("chat = ? AND thread_id = ?", chat, threadID).Order("id").Find(&bindings).Error
+	return bindings, err
+}
+
+func DeleteChatBindings(db *gorm.DB, chat int64, threadID int) error {
+	return db.Where("chat = ? AND thread_id = ?", chat, threadID).Delete(ChatBinding{}).Error
+}
+
+func GetCheckpoint(db *gorm.DB, name string) (checkpoint *Checkpoint, err error) {
+	checkpoint = new(Checkpoint)
+	err = db.Where(Checkpoint{Name: name}).First(checkpoint).Error
+	return checkpoint, err
+}
+
+func SaveCheckpoint(db *gorm.DB, checkpoint *Checkpoint) error {
+	return db.Save(checkpoint).Error
+}
+
+// SearchUsers finds users by a part of the phone, or by chat or Telegram user id
+func SearchUsers(db *gorm.DB, query string, limit int) (users []*User, err error) {
+	scope := db.Order("id").Limit(limit)
+	if query != "" {
+		scope = scope.Where("phone LIKE ? OR CAST(chat AS TEXT) = ? OR CAST(tg_user_id AS TEXT) = ?", "%"+query+"%", query, query)
+	}
+	err = scope.Find(&users).Error
+	return users, err
+}
+
+func GetUser(db *gorm.DB, id uint) (user *User, err error) {
+	user = new(User)
+	err = db.First(user, id).Error
+	return user, err
+}
+
+func UpdateUserRole(db *gorm.DB, user *User, isAdmin bool, redmineID int) error {
+	return db.Model(user).Updates(map[string]interface{}{
+		"is_admin":   isAdmin,
+		"redmine_id": redmineID,
+	}).Error
+}
+
+func GetMessage(db *gorm.DB, id uint) (message *Message, err error) {
+	message = new(Message)
+	err = db.First(message, id).Error
+	return message, err
+}
+
+func CreateDelivery(db *gorm.DB, delivery *Delivery) error {
+	return db.Create(delivery).Error
+}
+
+func SaveDelivery(db *gorm.DB, delivery *Delivery) error {
+	return db.Save(delivery).Error
+}
+
+func GetDelivery(db *gorm.DB, id uint) (delivery *Delivery, err error) {
+	delivery = new(Delivery)
+	err = db.First(delivery, id).Error
+	return delivery, err
+}
+
+// GetDeliveryByTGMessage - delivery of the issue that sent the Telegram message
+func GetDeliveryByTGMessage(db *gorm.DB, chat int64, tgMessageID int, issueID int) (delivery *Delivery, err error) {
+	delivery = new(Delivery)
+	err = db.Where("chat = ? AND tg_message_id = ? AND issue_id = ?", chat, tgMessageID, issueID).Last(delivery).Error
+	return delivery, err
+}
+
+// GetDeliveries - deliveries of the issue and/or to the Telegram users, newest first
+func GetDeliveries(db *gorm.DB, issueID int, tgUsers []int, limit int) (deliveries []*Delivery, err error) {
+	scope := db.Order("id DESC").Limit(limit)
+	if issueID != 0 {
+		scope = scope.Where("issue_id = ?", issueID)
+	}
+	if tgUsers != nil {
+		scope = scope.Where("tg_user_id IN (?)", tgUsers)
+	}
+	err = scope.Find(&deliveries).Error
+	return deliveries, err
+}
+
+// FinishOutboundDeliveries records the outcome of a flushed deferred message
+// in the deliveries collapsed into it
+func FinishOutboundDeliveries(db *gorm.DB, outboundID uint, status string, tgMessageID int, reason string, at time.Time) error {
+	fields := map[string]interface{}{
+		"status":        status,
+		"tg_message_id": tgMessageID,
+		"error":         reason,
+	}
+	if status == DeliverySent {
+		fields["sent_at"] = at
+	} else {
+		fields["failed_at"] = at
+	}
+	return db.Model(&Delivery{}).Where("outbound_id = ? AND status = ?", outboundID, DeliveryDeferred).Updates(fields).Error
+}
+
+// GetFailedWebhookEvents - the dead-letter queue: processed events that
+// ended with an error, newest first
+func GetFailedWebhookEvents(db *gorm.DB, limit int) (events []*WebhookEvent, err error) {
+	err = db.Where("processed = ? AND error <> ?", true, "").Order("id DESC").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// GetRecentWebhookEvents - the latest events, newest first
+func GetRecentWebhookEvents(db *gorm.DB, limit int) (events []*WebhookEvent, err error) {
+	err = db.Order("id DESC").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// ResetWebhookEvent makes the event pending again
+func ResetWebhookEvent(db *gorm.DB, event *WebhookEvent) error {
+	return db.Model(event).Updates(map[string]interface{}{
+		"processed": false,
+		"error":     "",
+	}).Error
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// UpdateHandlerFunc handles one Telegram update
+type UpdateHandlerFunc func(update TelegramUpdate)
+
+type callbackRoute struct {
+	prefix  string
+	handler UpdateHandlerFunc
+}
+
+// Dispatcher routes Telegram updates to registered handlers on a pool of
+// workers. Updates of one chat always go to the same worker, so they are
+// handled in order; a panic only loses the update that caused it.
+type Dispatcher struct {
+	workers   []chan TelegramUpdate
+	wg        sync.WaitGroup
+	messages  []UpdateHandlerFunc
+	callbacks []callbackRoute
+	inline    []UpdateHandlerFunc
+}
+
+// NewDispatcher ...
+func NewDispatcher(workers int, queueSize int) *Dispatcher {
+	if workers <= 0 {
+		workers = 4
+	}
+	if queueSize <= 0 {
+		queueSize = 100
+	}
+	d := &Dispatcher{}
+	for idx := 0; idx < workers; idx++ {
+		d.workers = append(d.workers, make(chan TelegramUpdate, queueSize))
+	}
+	return d
+}
+
+// HandleMessage registers handler of messages
+func (d *Dispatcher) HandleMessage(handler UpdateHandlerFunc) {
+	d.messages = append(d.messages, handler)
+}
+
+// HandleCallback registers handler of callback queries whose data starts with
+// prefix. The first matching route wins, "" matches any data.
+func (d *Dispatcher) HandleCallback(prefix string, handler UpdateHandlerFunc) {
+	d.callbacks = append(d.callbacks, callbackRoute{prefix: prefix, handler: handler})
+}
+
+// HandleInlineQuery registers handler of inline queries
+func (d *Dispatcher) HandleInlineQuery(handler UpdateHandlerFunc) {
+	d.inline = append(d.inline, handler)
+}
+
+// chatKey - the chat whose updates must stay in order
+func chatKey(update TelegramUpdate) int64 {
+	switch {
+	case update.Message != nil:
+		return update.Message.Chat.ID
+	case update.EditedMessage != nil:
+		return update.EditedMessage.Chat.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		return update.CallbackQuery.Message.Chat.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.From != nil:
+		return int64(update.CallbackQuery.From.ID)
+	case update.InlineQuery != nil && update.InlineQuery.From != nil:
+		return int64(update.InlineQuery.From.ID)
+	}
+	return 0
+}
+
+// Run dispatches updates until the channel is closed, then waits for the workers
+func (d *Dispatcher) Run(updates <-chan TelegramUpdate) {
+	for _, queue := range d.workers {
+		d.wg.Add(1)
+		go d.work(queue)
+	}
+	for update := range updates {
+		key := chatKey(update)
+		if key < 0 {
+			key = -key
+		}
+		d.workers[key%int64(len(d.workers))] <- update
+	}
+	for _, queue := range d.workers {
+		close(queue)
+	}
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) work(queue chan TelegramUpdate) {
+	defer d.wg.Done()
+	for update := range queue {
+		d.Dispatch(update)
+	}
+}
+
+// Dispatch calls the handlers of the update in the current goroutine
+func (d *Dispatcher) Dispatch(update TelegramUpdate) {
+	defer func() {
+		if r := recover(); r != nil {
+			dispatcherPanics.Inc()
+			logger.Error("update handler panicked", "update", update.UpdateID, "chat", chatKey(update), "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	switch {
+	case update.CallbackQuery != nil:
+		for _, route := range d.callbacks {
+			if strings.HasPrefix(update.CallbackQuery.Data, route.prefix) {
+				route.handler(update)
+				return
+			}
+		}
+	case update.Message != nil:
+		for _, handler := range d.messages {
+			handler(update)
+		}
+	case update.InlineQuery != nil:
+		for _, handler := range d.inline {
+			handler(update)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func messageUpdate(id int, chat int64, text string) TelegramUpdate {
+	return TelegramUpdate{Update: tgbotapi.Update{
+		UpdateID: id,
+		Message:  &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: chat}, Text: text},
+	}}
+}
+
+func TestDispatchRecoversPanic(t *testing.T) {
+	tests := []struct {
+		name   string
+		update TelegramUpdate
+		panics bool
+	}{
+		{"message handler", messageUpdate(1, 10, "boom"), true},
+		{"callback handler", TelegramUpdate{Update: tgbotapi.Update{
+			UpdateID:      2,
+			CallbackQuery: &tgbotapi.CallbackQuery{Data: "status:1", From: &tgbotapi.User{ID: 10}},
+		}}, true},
+		{"no panic", messageUpdate(3, 10, "ok"), false},
+	}
+
+	d := NewDispatcher(1, 1)
+	d.HandleMessage(func(update TelegramUpdate) {
+		if update.Message.Text == "boom" {
+			panic("boom")
+		}
+	})
+	d.HandleCallback("status:", func(update TelegramUpdate) {
+		panic("boom")
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(dispatcherPanics)
+			d.Dispatch(tt.update)
+			got := testutil.ToFloat64(dispatcherPanics) - before
+			want := 0.0
+			if tt.panics {
+				want = 1
+			}
+			if got != want {
+				t.Errorf("dispatcherPanics grew by %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDispatchCallbackRoutes(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"status:1", "status"},
+		{"lang:ru", "lang"},
+		{"other", "any"},
+	}
+
+	var got string
+	d := NewDispatcher(1, 1)
+	d.HandleCallback("status:", func(TelegramUpdate) { got = "status" })
+	d.HandleCallback("lang:", func(TelegramUpdate) { got = "lang" })
+	d.HandleCallback("", func(TelegramUpdate) { got = "any" })
+
+	for _, tt := range tests {
+		got = ""
+		d.Dispatch(TelegramUpdate{Update: tgbotapi.Update{
+			CallbackQuery: &tgbotapi.CallbackQuery{Data: tt.data, From: &tgbotapi.User{ID: 1}},
+		}})
+		if got != tt.want {
+			t.Errorf("data %q routed to %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestDispatcherRunKeepsChatOrder(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[int64][]int{}
+	d := NewDispatcher(3, 10)
+	d.HandleMessage(func(update TelegramUpdate) {
+		if update.Message.Text == "boom" {
+			panic("boom")
+		}
+		mu.Lock()
+		seen[update.Message.Chat.ID] = append(seen[update.Message.Chat.ID], update.UpdateID)
+		mu.Unlock()
+	})
+
+	updates := make(chan TelegramUpdate)
+	done := make(chan struct{})
+	go func() {
+		d.Run(updates)
+		close(done)
+	}()
+	id := 0
+	for round := 0; round < 20; round++ {
+		for _, chat := range []int64{1, -2, 3, 4} {
+			id++
+			text := "ok"
+			if round == 5 {
+				text = "boom"
+			}
+			updates <- messageUpdate(id, chat, text)
+		}
+	}
+	close(updates)
+	<-done
+
+	for chat, ids := range seen {
+		if len(ids) != 19 {
+			t.Errorf("chat %d: handled %d updates, want 19", chat, len(ids))
+		}
+		for idx := 1; idx < len(ids); idx++ {
+			if ids[idx] <= ids[idx-1] {
+				t.Errorf("chat %d: updates out of order: %v", chat, ids)
+				break
+			}
+		}
+	}
+	if len(seen) != 4 {
+		t.Errorf("handled %d chats, want 4", len(seen))
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Fake Redmine and Telegram servers used by TestScenarios, and a store for
+// the tests of single features
+
+// newTestStore - migrated SQLite database in a temporary directory
+func newTestStore(t *testing.T) *DBStore {
+	t.Helper()
+	db := newTestDB(t)
+	if _, err := MigrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	return NewDBStore(db)
+}
+
+// FakeCustomField - entry of custom_fields.json
+type FakeCustomField struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	CustomizedType string `json:"customized_type"`
+}
+
+// FakeGroup - Redmine group with its users
+type FakeGroup struct {
+	ID    int           `json:"id"`
+	Name  string        `json:"name"`
+	Users []RedmineUser `json:"users"`
+}
+
+// RedmineFixtures - data served by FakeRedmine
+type RedmineFixtures struct {
+	Statuses     []Status                       `json:"issue_statuses"`
+	Priorities   []Priority                     `json:"issue_priorities"`
+	Trackers     []Tracker                      `json:"trackers"`
+	Users        []RedmineUser                  `json:"users"`
+	CustomFields []FakeCustomField              `json:"custom_fields"`
+	Memberships  map[string][]Membership        `json:"memberships"` // project id -> members
+	Groups       map[string]FakeGroup           `json:"groups"`
+	Issues       map[string]Issue               `json:"issues"`
+	Journals     map[string][]APIJournal        `json:"journals"` // issue id -> journals
+	Versions     map[string]NamedObjectResponse `json:"versions"`
+	Categories   map[string]NamedObjectResponse `json:"issue_categories"`
+	Projects     map[string]NamedObjectResponse `json:"projects"`
+	// Failures - path (e.g. "users.json") -> HTTP status returned instead of data
+	Failures map[string]int `json:"failures"`
+}
+
+// RecordedRequest - a write request received by a fake server
+type RecordedRequest struct {
+	Method string
+	Path   string
+	Body   string
+}
+
+// FakeRedmine - in-process Redmine REST API
+type FakeRedmine struct {
+	server  *httptest.Server
+	token   string
+	mu      sync.Mutex
+	data    RedmineFixtures
+	writes  []RecordedRequest
+	uploads int
+}
+
+var (
+	fakeObjectRe      = regexp.MustCompile(`^(issues|versions|issue_categories|projects)/(\d+)\.json$`)
+	fakeMembershipsRe = regexp.MustCompile(`^projects/(\d+)/memberships\.json$`)
+	fakeGroupRe       = regexp.MustCompile(`^groups/(\d+)\.json$`)
+)
+
+// NewFakeRedmine starts the server, requests must carry token in X-Redmine-API-Key
+func NewFakeRedmine(data RedmineFixtures, token string) *FakeRedmine {
+	fake := &FakeRedmine{data: data, token: token}
+	if fake.data.Issues == nil {
+		fake.data.Issues = make(map[string]Issue)
+	}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+// URL - value for Config.RedmineAPIHost
+func (f *FakeRedmine) URL() string {
+	return f.server.URL + "/"
+}
+
+// Writes returns POST and PUT requests received so far
+func (f *FakeRedmine) Writes() []RecordedRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]RecordedRequest(nil), f.writes...)
+}
+
+// Close ...
+func (f *FakeRedmine) Close() {
+	f.server.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// fakePage cuts list by limit and offset query parameters like Redmine does
+func fakePage(r *http.Request, total int) (start int, end int) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if limit <= 0 {
+		limit = 25
+	}
+	start, end = offset, offset+limit
+	if start > total {
+		start = total
+	}
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+func (f *FakeRedmine) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Redmine-API-Key") != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if status, ok := f.data.Failures[path]; ok {
+		writeJSON(w, status, map[string][]string{"errors": {http.StatusText(status)}})
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Method == "POST" || r.Method == "PUT" {
+		f.writes = append(f.writes, RecordedRequest{Method: r.Method, Path: path, Body: string(body)})
+	}
+
+	switch {
+	case r.Method == "GET" && path == "issue_statuses.json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"issue_statuses": f.data.Statuses})
+	case r.Method == "GET" && path == "enumerations/issue_priorities.json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"issue_priorities": f.data.Priorities})
+	case r.Method == "GET" && path == "trackers.json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"trackers": f.data.Trackers})
+	case r.Method == "GET" && path == "custom_fields.json":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"custom_fields": f.data.CustomFields})
+	case r.Method == "GET" && path == "users.json":
+		start, end := fakePage(r, len(f.data.Users))
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"users":       f.data.Users[start:end],
+			"total_count": len(f.data.Users),
+		})
+	case r.Method == "GET" && fakeMembershipsRe.MatchString(path):
+		members := f.data.Memberships[fakeMembershipsRe.FindStringSubmatch(path)[1]]
+		start, end := fakePage(r, len(members))
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"memberships": members[start:end],
+			"total_count": len(members),
+		})
+	case r.Method == "GET" && fakeGroupRe.MatchString(path):
+		group, ok := f.data.Groups[fakeGroupRe.FindStringSubmatch(path)[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"group": group})
+	case r.Method == "GET" && path == "issues.json":
+		f.serveIssues(w, r)
+	case r.Method == "POST" && path == "uploads.json":
+		f.uploads++
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"upload": map[string]string{"token": fmt.Sprintf("%d.fake", f.uploads)},
+		})
+	case fakeObjectRe.MatchString(path):
+		groups := fakeObjectRe.FindStringSubmatch(path)
+		f.serveObject(w, r, groups[1], groups[2], body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveIssues lists issues, only the updated_on=>=<time> filter is supported
+func (f *FakeRedmine) serveIssues(w http.ResponseWriter, r *http.Request) {
+	since := parseRedmineTime(strings.TrimPrefix(r.URL.Query().Get("updated_on"), ">="))
+	issues := []Issue{}
+	for _, issue := range f.data.Issues {
+		if !parseRedmineTime(issue.UpdatedOn).Before(since) {
+			issues = append(issues, issue)
+		}
+	}
+	sort.Slice(issues, func(i, j int) bool { return issues[i].UpdatedOn < issues[j].UpdatedOn })
+	start, end := fakePage(r, len(issues))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issues":      issues[start:end],
+		"total_count": len(issues),
+	})
+}
+
+func (f *FakeRedmine) serveObject(w http.ResponseWriter, r *http.Request, kind string, id string, body []byte) {
+	if kind == "issues" {
+		issue, ok := f.data.Issues[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			if strings.Contains(r.URL.Query().Get("include"), "journals") {
+				var response IssueJournalsResponse
+				response.Issue.Issue = issue
+				response.Issue.Journals = f.data.Journals[id]
+				writeJSON(w, http.StatusOK, response)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"issue": issue})
+		case "PUT":
+			var update struct {
+				Issue struct {
+					StatusID int `json:"status_id"`
+				} `json:"issue"`
+			}
+			json.Unmarshal(body, &update)
+			if update.Issue.StatusID != 0 {
+				issue.Status = Status{ID: update.Issue.StatusID}
+				for _, status := range f.data.Statuses {
+					if status.ID == update.Issue.StatusID {
+						issue.Status = status
+					}
+				}
+				f.data.Issues[id] = issue
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	objects := map[string]map[string]NamedObjectResponse{
+		"versions":         f.data.Versions,
+		"issue_categories": f.data.Categories,
+		"projects":         f.data.Projects,
+	}[kind]
+	object, ok := objects[id]
+	if !ok || r.Method != "GET" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	root := map[string]string{
+		"versions":         "version",
+		"issue_categories": "issue_category",
+		"projects":         "project",
+	}[kind]
+	writeJSON(w, http.StatusOK, map[string]interface{}{root: object})
+}
+
+// SentMessage - sendMessage call received by FakeTelegram
+type SentMessage struct {
+	ChatID      int64  `json:"chat"`
+	ThreadID    int    `json:"thread"`
+	Text        string `json:"text"`
+	ParseMode   string `json:"parse_mode"`
+	ReplyMarkup string `json:"reply_markup"`
+}
+
+// FakeTelegram - in-process Bot API, records sent messages
+type FakeTelegram struct {
+	server *httptest.Server
+	mu     sync.Mutex
+	sent   []SentMessage
+	nextID int
+	// failures - chat id -> error description, e.g. "Forbidden: bot was blocked by the user"
+	failures map[int64]string
+}
+
+// NewFakeTelegram starts the server
+func NewFakeTelegram(failures map[int64]string) *FakeTelegram {
+	fake := &FakeTelegram{failures: failures}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+// Client returns http.Client that sends api.telegram.org requests to the fake
+func (f *FakeTelegram) Client() *http.Client {
+	target, _ := url.Parse(f.server.URL)
+	return &http.Client{Transport: redirectTransport{target: target}}
+}
+
+// Sent returns messages sent so far
+func (f *FakeTelegram) Sent() []SentMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]SentMessage(nil), f.sent...)
+}
+
+// Close ...
+func (f *FakeTelegram) Close() {
+	f.server.Close()
+}
+
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	r.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (f *FakeTelegram) serve(w http.ResponseWriter, r *http.Request) {
+	// /bot<token>/<method>
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	r.ParseForm()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch method {
+	case "getMe":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ok":     true,
+			"result": map[string]interface{}{"id": 1, "is_bot": true, "first_name": "Fake", "username": "fake_bot"},
+		})
+	case "sendMessage":
+		chatID, _ := strconv.ParseInt(r.PostForm.Get("chat_id"), 10, 64)
+		if description, ok := f.failures[chatID]; ok {
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{
+				"ok": false, "error_code": http.StatusForbidden, "description": description,
+			})
+			return
+		}
+		f.nextID++
+		threadID, _ := strconv.Atoi(r.PostForm.Get("message_thread_id"))
+		f.sent = append(f.sent, SentMessage{
+			ChatID:      chatID,
+			ThreadID:    threadID,
+			Text:        r.PostForm.Get("text"),
+			ParseMode:   r.PostForm.Get("parse_mode"),
+			ReplyMarkup: r.PostForm.Get("reply_markup"),
+		})
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ok": true,
+			"result": map[string]interface{}{
+				"message_id": f.nextID,
+				"date":       0,
+				"chat":       map[string]interface{}{"id": chatID, "type": "private"},
+				"text":       r.PostForm.Get("text"),
+			},
+		})
+	case "getChat":
+		chatID, _ := strconv.ParseInt(r.PostForm.Get("chat_id"), 10, 64)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ok":     true,
+			"result": map[string]interface{}{"id": chatID, "type": "channel", "title": fmt.Sprintf("Channel %d", chatID)},
+		})
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "result": true})
+	}
+}
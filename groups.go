@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Groups and channels receive notifications of the projects, trackers and
+// assignees bound to them. An admin registers the chat with /register and binds
+// the chat or the current forum topic with /bind.
+
+// groupResolver - registered group chats and topics bound to the issue
+type groupResolver struct {
+	store Store
+}
+
+func (binding *ChatBinding) matches(issue Issue) bool {
+	return (binding.ProjectID == 0 || binding.ProjectID == issue.Project.ID) &&
+		(binding.TrackerID == 0 || binding.TrackerID == issue.Tracker.ID) &&
+		(binding.AssigneeID == 0 || binding.AssigneeID == issueAssigneeID(issue))
+}
+
+func (r *groupResolver) Resolve(ctx context.Context, event *IssueEvent) (recipients []Recipient, err error) {
+	bindings, err := r.store.GetChatBindings()
+	if err != nil {
+		return nil, err
+	}
+	for _, binding := range bindings {
+		if !binding.matches(event.Request.Payload.Issue) {
+			continue
+		}
+		group, err := r.store.GetGroupChat(binding.Chat)
+		if err != nil {
+			loggerFrom(ctx).Error("group chat lookup failed", "chat", binding.Chat, "err", err)
+			continue
+		}
+		recipients = append(recipients, Recipient{
+			User:     group.user(),
+			ThreadID: binding.ThreadID,
+			Template: staffTemplate,
+		})
+	}
+	return recipients, nil
+}
+
+// user - recipient settings of the group, groups have no bot user
+func (group *GroupChat) user() *User {
+	return &User{Chat: group.Chat, Language: group.Language, ChatFailed: group.ChatFailed}
+}
+
+// chatUser - recipient settings of a chat known only by id: those of the
+// registered group, default ones if the group is not registered
+func chatUser(store Store, chat int64) (*User, error) {
+	group, err := store.GetGroupChat(chat)
+	if err == ErrNotFound {
+		return &User{Chat: chat}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return group.user(), nil
+}
+
+// issueAssigneeID - assignee of the issue from a webhook payload or the REST API
+func issueAssigneeID(issue Issue) int {
+	if issue.Assignee.ID != 0 {
+		return issue.Assignee.ID
+	}
+	return issue.AssignedTo.ID
+}
+
+// GroupHandler - /register, /bind, /unbind and /bindings commands
+type GroupHandler struct {
+	store   Store
+	bot     Messenger
+	redmine IssueTracker
+	i18n    *Translator
+}
+
+// NewGroupHandler ...
+func NewGroupHandler(store Store, bot Messenger, redmine IssueTracker, i18n *Translator) *GroupHandler {
+	return &GroupHandler{
+		store:   store,
+		bot:     bot,
+		redmine: redmine,
+		i18n:    i18n,
+	}
+}
+
+func (gh *GroupHandler) reply(message *tgbotapi.Message, threadID int, text string) {
+	newMessage := tgbotapi.NewMessage(message.Chat.ID, text)
+	if threadID == 0 {
+		gh.bot.Send(newMessage)
+		return
+	}
+	if _, err := sendThreadMessage(gh.bot, ThreadMessage{MessageConfig: newMessage, ThreadID: threadID}); err != nil {
+		logger.Error("group reply failed", "chat", message.Chat.ID, "thread", threadID, "err", err)
+	}
+}
+
+// Handle processes messages from groups and group commands from private chats.
+// Returns false for messages that are left to AuthHandler.
+func (gh *GroupHandler) Handle(message *tgbotapi.Message, threadID int) bool {
+	private := message.Chat.IsPrivate()
+	command := ""
+	if message.IsCommand() {
+		command = message.Command()
+	}
+	switch command {
+	case "register", "bind", "unbind", "bindings":
+	default:
+		// Only private chats talk to AuthHandler
+		return !private
+	}
+	if message.From == nil {
+		return true
+	}
+
+	admin, err := gh.store.GetUserByTGUser(message.From.ID)
+	lang := gh.i18n.Language(message.From.LanguageCode)
+	if err == nil && admin.Language != "" {
+		lang = gh.i18n.Language(admin.Language)
+	}
+	if err != nil || !admin.IsAdmin {
+		gh.reply(message, threadID, gh.i18n.T(lang, "groups.admin_only"))
+		return true
+	}
+
+	args := strings.Fields(message.CommandArguments())
+	chat := message.Chat.ID
+	if private {
+		threadID = 0
+	}
+	switch command {
+	case "register":
+		gh.register(message, threadID, args, lang)
+		return true
+	case "bindings":
+		gh.listBindings(message, threadID, private, lang)
+		return true
+	}
+
+	binding, err := parseBinding(args, private)
+	if err != nil || (private && binding.Chat == 0) {
+		gh.reply(message, threadID, gh.i18n.T(lang, "groups."+command+"_usage"))
+		return true
+	}
+	if !private {
+		binding.Chat, binding.ThreadID = chat, threadID
+	}
+	if _, err := gh.store.GetGroupChat(binding.Chat); err != nil {
+		gh.reply(message, threadID, gh.i18n.T(lang, "groups.not_registered", binding.Chat))
+		return true
+	}
+
+	if command == "unbind" {
+		if err := gh.store.DeleteChatBindings(binding.Chat, binding.ThreadID); err != nil {
+			logger.Error("unbind failed", "chat", binding.Chat, "thread", binding.ThreadID, "err", err)
+			return true
+		}
+		gh.reply(message, threadID, gh.i18n.T(lang, "groups.unbound"))
+		return true
+	}
+	if binding.ProjectID == 0 && binding.TrackerID == 0 && binding.AssigneeID == 0 {
+		gh.reply(message, threadID, gh.i18n.T(lang, "groups.bind_usage"))
+		return true
+	}
+	if err := gh.store.CreateChatBinding(binding); err != nil {
+		logger.Error("bind failed", "chat", binding.Chat, "thread", binding.ThreadID, "err", err)
+		return true
+	}
+	logger.Info("chat bound", "chat", binding.Chat, "thread", binding.ThreadID, "admin", message.From.ID)
+	gh.reply(message, threadID, gh.i18n.T(lang, "groups.bound", gh.describe(binding, lang)))
+	return true
+}
+
+// register handles "/register" in a group and "/register <chat id>" in a private chat
+func (gh *GroupHandler) register(message *tgbotapi.Message, threadID int, args []string, lang string) {
+	chat := message.Chat
+	if chat.IsPrivate() {
+		if len(args) != 1 {
+			gh.reply(message, threadID, gh.i18n.T(lang, "groups.register_usage"))
+			return
+		}
+		chatID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			gh.reply(message, threadID, gh.i18n.T(lang, "groups.register_usage"))
+			return
+		}
+		// The bot must be a member of the channel to see it
+		chat, err = gh.getChat(chatID)
+		if err != nil {
+			logger.Warn("chat lookup failed", "chat", chatID, "err", err)
+			gh.reply(message, threadID, gh.i18n.T(lang, "groups.unknown_chat", chatID))
+			return
+		}
+	}
+
+	group, err := gh.store.RegisterGroupChat(chat.ID, chat.Title, chat.Type, lang)
+	if err != nil {
+		logger.Error("chat registration failed", "chat", chat.ID, "err", err)
+		return
+	}
+	gh.reply(message, threadID, gh.i18n.T(lang, "groups.registered", group.Title, group.Chat))
+}
+
+func (gh *GroupHandler) getChat(chatID int64) (*tgbotapi.Chat, error) {
+	params := url.Values{}
+	params.Add("chat_id", strconv.FormatInt(chatID, 10))
+	resp, err := gh.bot.MakeRequest("getChat", params)
+	if err != nil {
+		return nil, err
+	}
+	chat := new(tgbotapi.Chat)
+	err = json.Unmarshal(resp.Result, chat)
+	return chat, err
+}
+
+// parseBinding parses "project 3 tracker 2 assignee 7", private chats
+// also name the target with "chat <id> [topic <id>]"
+func parseBinding(args []string, private bool) (*ChatBinding, error) {
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("odd number of arguments")
+	}
+	binding := new(ChatBinding)
+	for i := 0; i < len(args); i += 2 {
+		id, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case args[i] == "project":
+			binding.ProjectID = int(id)
+		case args[i] == "tracker":
+			binding.TrackerID = int(id)
+		case args[i] == "assignee":
+			binding.AssigneeID = int(id)
+		case args[i] == "chat" && private:
+			binding.Chat = id
+		case args[i] == "topic" && private:
+			binding.ThreadID = int(id)
+		default:
+			return nil, fmt.Errorf("unknown key %q", args[i])
+		}
+	}
+	return binding, nil
+}
+
+func (gh *GroupHandler) describe(binding *ChatBinding, lang string) string {
+	var parts []string
+	if binding.ProjectID != 0 {
+		parts = append(parts, gh.i18n.T(lang, "groups.project", binding.ProjectID))
+	}
+	if binding.TrackerID != 0 {
+		parts = append(parts, gh.i18n.T(lang, "groups.tracker", binding.TrackerID))
+	}
+	if binding.AssigneeID != 0 {
+		parts = append(parts, gh.i18n.T(lang, "groups.assignee", binding.AssigneeID))
+	}
+	target := strconv.FormatInt(binding.Chat, 10)
+	if binding.ThreadID != 0 {
+		target = gh.i18n.T(lang, "groups.topic", target, binding.ThreadID)
+	}
+	return fmt.Sprintf("%s → %s", strings.Join(parts, ", "), target)
+}
+
+// listBindings lists bindings of the current topic, or all bindings in a private chat
+func (gh *GroupHandler) listBindings(message *tgbotapi.Message, threadID int, private bool, lang string) {
+	var (
+		bindings []*ChatBinding
+		err      error
+	)
+	if private {
+		bindings, err = gh.store.GetChatBindings()
+	} else {
+		bindings, err = gh.store.GetChatBindingsByChat(message.Chat.ID, threadID)
+	}
+	if err != nil {
+		logger.Error("bindings lookup failed", "chat", message.Chat.ID, "err", err)
+		return
+	}
+	if len(bindings) == 0 {
+		gh.reply(message, threadID, gh.i18n.T(lang, "groups.bindings_none"))
+		return
+	}
+	lines := []string{gh.i18n.T(lang, "groups.bindings_header")}
+	for _, binding := range bindings {
+		lines = append(lines, gh.describe(binding, lang))
+	}
+	gh.reply(message, threadID, strings.Join(lines, "\n"))
+}
+
+// CanChangeStatus checks the user who pressed a status button. Callback data
+// comes from the client and can be forged, so the presser must be the recipient
+// of the notification the button is attached to, a registered admin or the
+// assignee of the issue.
+func (gh *GroupHandler) CanChangeStatus(ctx context.Context, query *tgbotapi.CallbackQuery, issueID int) (bool, error) {
+	if query.Message == nil || query.From == nil {
+		return false, nil
+	}
+	recipient, err := gh.isRecipient(query, issueID)
+	if err != nil || recipient {
+		return recipient, err
+	}
+	user, err := gh.store.GetUserByTGUser(query.From.ID)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if user.IsAdmin {
+		return true, nil
+	}
+	issue, err := gh.redmine.GetIssue(ctx, issueID)
+	if err != nil {
+		return false, err
+	}
+	return user.RedmineID != 0 && user.RedmineID == issueAssigneeID(*issue), nil
+}
+
+// isRecipient - the pressed message is a notification about the issue sent to the presser
+func (gh *GroupHandler) isRecipient(query *tgbotapi.CallbackQuery, issueID int) (bool, error) {
+	delivery, err := gh.store.GetDeliveryByTGMessage(query.Message.Chat.ID, query.Message.MessageID, issueID)
+	if err == ErrNotFound || (err == nil && delivery.MessageID == 0) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	message, err := gh.store.GetMessage(delivery.MessageID)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return message.TGUser != 0 && message.TGUser == query.From.ID && message.IssueID == issueID, nil
+}
+
+// DenyCallback tells the presser they can't change the issue
+func (gh *GroupHandler) DenyCallback(query *tgbotapi.CallbackQuery) {
+	lang := gh.i18n.Language("")
+	if query.From != nil {
+		lang = gh.i18n.Language(query.From.LanguageCode)
+		if user, err := gh.store.GetUserByTGUser(query.From.ID); err == nil && user.Language != "" {
+			lang = gh.i18n.Language(user.Language)
+		}
+	}
+	gh.bot.AnswerCallbackQuery(tgbotapi.NewCallbackWithAlert(query.ID, gh.i18n.T(lang, "groups.callback_denied")))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// stubTracker - IssueTracker where every issue is a copy of issue
+type stubTracker struct {
+	IssueTracker
+	issue Issue
+}
+
+func (s stubTracker) GetIssue(ctx context.Context, id int) (*Issue, error) {
+	issue := s.issue
+	issue.ID = id
+	return &issue, nil
+}
+
+func TestCanChangeStatus(t *testing.T) {
+	store := newTestStore(t)
+	for _, user := range []*User{
+		{Chat: 100, TGUser: 100, RedmineID: 1, IsAdmin: true},
+		{Chat: 200, TGUser: 200, RedmineID: 2},
+		{Chat: 300, TGUser: 300, RedmineID: 3},
+	} {
+		if err := store.db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The notification about issue 101 sent to user 300 is message 7 of chat 300
+	message, err := store.GetOrCreateMessage(300, 101, "Новая", "Протечка", "", true, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := &Delivery{IssueID: 101, TGUser: 300, Chat: 300, MessageID: message.ID, TGMessageID: 7, Status: DeliverySent}
+	if err := store.CreateDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+	var issue Issue
+	issue.AssignedTo.ID = 2
+	gh := NewGroupHandler(store, nil, stubTracker{issue: issue}, nil)
+
+	private := func(chat int64) *tgbotapi.Chat { return &tgbotapi.Chat{ID: chat, Type: "private"} }
+	group := &tgbotapi.Chat{ID: -1001, Type: "supergroup"}
+	tests := []struct {
+		name    string
+		from    int
+		message *tgbotapi.Message
+		issueID int
+		allowed bool
+	}{
+		{"recipient of the notification", 300, &tgbotapi.Message{MessageID: 7, Chat: private(300)}, 101, true},
+		{"forged issue in the recipient's chat", 300, &tgbotapi.Message{MessageID: 7, Chat: private(300)}, 102, false},
+		{"other message of the recipient", 300, &tgbotapi.Message{MessageID: 8, Chat: private(300)}, 101, false},
+		{"admin in a private chat", 100, &tgbotapi.Message{MessageID: 1, Chat: private(100)}, 102, true},
+		{"assignee in a group", 200, &tgbotapi.Message{MessageID: 1, Chat: group}, 101, true},
+		{"stranger in a group", 300, &tgbotapi.Message{MessageID: 1, Chat: group}, 101, false},
+		{"unregistered user", 900, &tgbotapi.Message{MessageID: 1, Chat: private(900)}, 101, false},
+		{"inline message without Message", 100, nil, 101, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := &tgbotapi.CallbackQuery{From: &tgbotapi.User{ID: tt.from}, Message: tt.message}
+			allowed, err := gh.CanChangeStatus(context.Background(), query, tt.issueID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+}
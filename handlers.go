@@ -1,57 +1,111 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"encoding/json"
-	"io/ioutil"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
-	"github.com/jinzhu/gorm"
 )
 
 var (
-	ErrValueNotFound    = errors.New("Value not found")
-	ErrFieldNotDeclared = errors.New("Field not declared")
+	ErrValueNotFound = errors.New("Value not found")
 )
 
 // IssuesHandler ...
 type IssuesHandler struct {
 	config    Config
-	bot       *tgbotapi.BotAPI
-	redmine   *RedmineClient
-	updates   chan RedmineRequest
+	redmine   IssueTracker
+	store     Store
+	updates   chan QueuedEvent
 	closeChan chan interface{}
-	db        *gorm.DB
+	closeOnce sync.Once
+	done      chan interface{}
+	workers   []chan QueuedEvent
+	notifier  *Notifier
+	templates *TemplateStore
+	i18n      *Translator
+	resolvers []RecipientResolver
+
+	// Webhook and poller may deliver the same change at once
+	enqueueMu sync.Mutex
+	// Events handed to workers and not processed yet, they are not submitted again
+	inflightMu sync.Mutex
+	inflight   map[uint]bool
 }
 
 // NewIssuesHandler ...
-func NewIssuesHandler(config Config, bot *tgbotapi.BotAPI, redmine *RedmineClient, updates chan RedmineRequest) *IssuesHandler {
+func NewIssuesHandler(config Config, redmine IssueTracker, store Store, notifier *Notifier, templates *TemplateStore, i18n *Translator, updates chan QueuedEvent) *IssuesHandler {
 	handler := &IssuesHandler{
 		config:    config,
-		bot:       bot,
 		redmine:   redmine,
+		store:     store,
+		notifier:  notifier,
+		templates: templates,
+		i18n:      i18n,
 		updates:   updates,
 		closeChan: make(chan interface{}),
-		db:        NewDBInstance(config.DbFile),
+		done:      make(chan interface{}),
+		inflight:  make(map[uint]bool),
+		resolvers: []RecipientResolver{
+			&staffResolver{redmine: redmine, store: store},
+			&clientResolver{store: store},
+			&groupResolver{store: store},
+		},
+	}
+	workers := config.IssueWorkers
+	if workers <= 0 {
+		workers = 4
+	}
+	for idx := 0; idx < workers; idx++ {
+		handler.workers = append(handler.workers, make(chan QueuedEvent, config.QueueSize))
 	}
 	return handler
 }
 
-// Run ...
+// AddResolver adds one more source of recipients
+func (h *IssuesHandler) AddResolver(resolver RecipientResolver) {
+	h.resolvers = append(h.resolvers, resolver)
+}
+
+// Run hands queued webhook events to the workers. Events that didn't fit into
+// the queue or were left over from the previous run are picked up from the database.
 func (h *IssuesHandler) Run() {
+	var wg sync.WaitGroup
+	for _, queue := range h.workers {
+		wg.Add(1)
+		go func(queue chan QueuedEvent) {
+			defer wg.Done()
+			for event := range queue {
+				h.processEvent(context.Background(), event.ID)
+				h.release(event.ID)
+			}
+		}(queue)
+	}
+	defer func() {
+		// Workers finish what is already queued, the rest stays pending in the database
+		for _, queue := range h.workers {
+			close(queue)
+		}
+		wg.Wait()
+		close(h.done)
+	}()
+
+	h.processPending()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
 	for {
 		select {
-		case issue := <-h.updates:
-			h.sendNotifications(issue)
+		case event := <-h.updates:
+			h.submit(event)
+		case <-ticker.C:
+			h.processPending()
 		case <-h.closeChan:
 			return
-		default:
-			time.Sleep(300 * time.Millisecond)
 		}
 	}
 }
@@ -61,6 +115,7 @@ type JournalDetail struct {
 	DetailType int
 	OldValue   string
 	NewValue   string
+	URL        string
 }
 
 type TemplateData struct {
@@ -71,15 +126,54 @@ type TemplateData struct {
 	Subject     string
 	Description string
 	PhoneNumber string
-	Address		string
+	Address     string
 	Status      string
 	Assignee    string
 	Notes       string
+	CreatedOn   string
+	UpdatedOn   string
 	Journals    []JournalDetail
 }
 
-func (h *IssuesHandler) getIssueStatusName(value string) (string, error) {
-	statuses, err := h.redmine.GetIssueStatuses()
+// ClientTemplateData - data for notifications sent to clients
+type ClientTemplateData struct {
+	IssueID  int
+	StatusID int
+	Status   string
+	Subject  string
+	Phone    string
+}
+
+// Custom fields of the issue filled in for clients
+const (
+	clientAddressField = 15
+	clientPhoneField   = 19
+	clientNotifyField  = 23
+)
+
+func customFieldValue(issue Issue, id int) string {
+	for _, field := range issue.CustomFieldValues {
+		if field.ID == id {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// clientPhoneFromCustomFields returns client phone (custom field 19) in 7XXXXXXXXXX
+// form and whether the client asked for notifications (custom field 23)
+func clientPhoneFromCustomFields(issue Issue) (phone string, notify bool) {
+	if value := customFieldValue(issue, clientPhoneField); value != "" {
+		buffer_number := []rune(value)
+		buffer_number[0] = '7'
+		phone = string(buffer_number)
+	}
+	notify = customFieldValue(issue, clientNotifyField) == strconv.Itoa(1)
+	return phone, notify
+}
+
+func (h *IssuesHandler) getIssueStatusName(ctx context.Context, value string) (string, error) {
+	statuses, err := h.redmine.GetIssueStatuses(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -91,8 +185,8 @@ func (h *IssuesHandler) getIssueStatusName(value string) (string, error) {
 	return "", ErrValueNotFound
 }
 
-func (h *IssuesHandler) getIssuePriorityName(value string) (string, error) {
-	priorities, err := h.redmine.GetIssuePriorities()
+func (h *IssuesHandler) getIssuePriorityName(ctx context.Context, value string) (string, error) {
+	priorities, err := h.redmine.GetIssuePriorities(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -104,8 +198,8 @@ func (h *IssuesHandler) getIssuePriorityName(value string) (string, error) {
 	return "", ErrValueNotFound
 }
 
-func (h *IssuesHandler) getUserName(value string) (string, error) {
-	users, err := h.redmine.GetUsers()
+func (h *IssuesHandler) getUserName(ctx context.Context, value string) (string, error) {
+	users, err := h.redmine.GetUsers(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -117,25 +211,94 @@ func (h *IssuesHandler) getUserName(value string) (string, error) {
 	return "", ErrValueNotFound
 }
 
-func (h *IssuesHandler) getFieldName(detail Detail) (string, error) {
-	var detailName string
+func (h *IssuesHandler) getTrackerName(ctx context.Context, value string) (string, error) {
+	trackers, err := h.redmine.GetTrackers(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, v := range trackers.Trackers {
+		if strconv.Itoa(v.ID) == value {
+			return v.Name, nil
+		}
+	}
+	return "", ErrValueNotFound
+}
+
+// getObjectName resolves id with one of IssueTracker getters of named objects
+func (h *IssuesHandler) getObjectName(ctx context.Context, get func(context.Context, int) (*NamedObjectResponse, error), value string) (string, error) {
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return "", ErrValueNotFound
+	}
+	object, err := get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if object.Subject != "" {
+		return fmt.Sprintf("#%d %s", object.ID, object.Subject), nil
+	}
+	return object.Name, nil
+}
+
+// getCustomFieldName looks the field up in custom_fields.json (admin only),
+// falling back to the custom fields of the issue itself
+func (h *IssuesHandler) getCustomFieldName(ctx context.Context, issue Issue, id string) (string, error) {
+	if fields, err := h.redmine.GetCustomFields(ctx); err == nil {
+		for _, field := range fields.CustomFields {
+			if strconv.Itoa(field.ID) == id {
+				return field.Name, nil
+			}
+		}
+	}
+	for _, field := range issue.CustomFieldValues {
+		if strconv.Itoa(field.ID) == id {
+			return field.Name, nil
+		}
+	}
+	return "", ErrValueNotFound
+}
+
+// getFieldName returns a label for the changed property. Attributes are
+// labelled from "field.<prop_key>" catalog keys, unknown ones by the key itself.
+// Custom field names come from Redmine and are resolved in resolveJournal.
+func (h *IssuesHandler) getFieldName(detail Detail, lang string) string {
+	propKey := fmt.Sprintf("%v", detail.PropKey)
+	switch detail.Property {
+	case "attachment":
+		return h.i18n.T(lang, "field.attachment")
+	case "relation":
+		return h.i18n.T(lang, "field.relation")
+	}
+	if h.i18n.Has(lang, "field."+propKey) {
+		return h.i18n.T(lang, "field."+propKey)
+	}
+	return propKey
+}
+
+// resolveValue turns ids in journal values into names
+func (h *IssuesHandler) resolveValue(ctx context.Context, detail Detail, value string) (string, error) {
+	if detail.Property != "attr" {
+		return value, nil
+	}
 	switch detail.PropKey {
 	case "status_id":
-		detailName = "Статус"
+		return h.getIssueStatusName(ctx, value)
 	case "priority_id":
-		detailName = "Приоритет"
-	case "due_date":
-		detailName = "Дата выполнения"
+		return h.getIssuePriorityName(ctx, value)
 	case "assigned_to_id":
-		detailName = "Назначена"
-	case "done_ratio":
-		detailName = "Готовность"
-	case "subject":
-		detailName = "Тема"
-	default:
-		return "", ErrFieldNotDeclared
+		return h.getUserName(ctx, value)
+	case "tracker_id":
+		return h.getTrackerName(ctx, value)
+	case "fixed_version_id":
+		return h.getObjectName(ctx, h.redmine.GetVersion, value)
+	case "category_id":
+		return h.getObjectName(ctx, h.redmine.GetIssueCategory, value)
+	case "project_id":
+		return h.getObjectName(ctx, h.redmine.GetProject, value)
+	case "parent_id":
+		return h.getObjectName(ctx, h.redmine.GetIssueSubject, value)
 	}
-	return detailName, nil
+	return value, nil
 }
 
 func (h *IssuesHandler) getDetailType(detail Detail) int {
@@ -150,79 +313,94 @@ func (h *IssuesHandler) getDetailType(detail Detail) int {
 	return 0
 }
 
-func (h *IssuesHandler) fillJournalDetails(details []Detail, data *TemplateData) error {
-	for _, detail := range details {
-		if detail.Property == "cf" { // Skip custom fields
-			continue
-		}
+// Long values like description are cut in notifications
+const journalValueLimit = 300
 
-		oldValue := fmt.Sprintf("%v", detail.OldValue)
-		newValue := fmt.Sprintf("%v", detail.Value)
+// lookupFallback logs a failed id lookup and returns a "#<id>" placeholder,
+// so that one deleted or locked object doesn't cancel the whole notification
+func lookupFallback(ctx context.Context, detail Detail, value string, err error) string {
+	loggerFrom(ctx).Warn("journal value lookup failed", "property", detail.Property, "prop_key", detail.PropKey, "value", value, "err", err)
+	journalLookupFailures.WithLabelValues(fmt.Sprintf("%v", detail.PropKey)).Inc()
+	return "#" + value
+}
 
-		detailType := h.getDetailType(detail)
-		fieldName, err := h.getFieldName(detail)
-		if err == ErrFieldNotDeclared {
-			continue
-		}
-		if detail.PropKey == "status_id" {
-			oldValue, err = h.getIssueStatusName(oldValue)
-			if err == ErrValueNotFound {
-				return err
-			}
-			newValue, err = h.getIssueStatusName(newValue)
-			if err == ErrValueNotFound {
-				return err
-			}
-		} else if detail.PropKey == "priority_id" {
-			oldValue, err = h.getIssuePriorityName(oldValue)
-			if err == ErrValueNotFound {
-				return err
-			}
-			newValue, err = h.getIssuePriorityName(newValue)
-			if err == ErrValueNotFound {
-				return err
+// resolvedDetail - journal detail with ids turned into names, the same for every language
+type resolvedDetail struct {
+	Detail   Detail
+	Name     string // custom field name, attributes are labelled per language
+	OldValue string
+	NewValue string
+	URL      string
+}
+
+// resolveJournal looks up names of everything the journal refers to
+func (h *IssuesHandler) resolveJournal(ctx context.Context, issue Issue, details []Detail) (resolved []resolvedDetail) {
+	for _, detail := range details {
+		item := resolvedDetail{Detail: detail}
+		var err error
+
+		if detail.Property == "cf" {
+			propKey := fmt.Sprintf("%v", detail.PropKey)
+			if item.Name, err = h.getCustomFieldName(ctx, issue, propKey); err != nil {
+				item.Name = lookupFallback(ctx, detail, propKey, err)
 			}
-		} else if detail.PropKey == "assigned_to_id" {
-			oldValue, err = h.getUserName(oldValue)
-			if err == ErrValueNotFound {
-				return err
+		}
+		if detail.OldValue != nil {
+			value := fmt.Sprintf("%v", detail.OldValue)
+			if item.OldValue, err = h.resolveValue(ctx, detail, value); err != nil {
+				item.OldValue = lookupFallback(ctx, detail, value, err)
 			}
-			newValue, err = h.getUserName(newValue)
-			if err == ErrValueNotFound {
-				return err
+		}
+		if detail.Value != nil {
+			value := fmt.Sprintf("%v", detail.Value)
+			if item.NewValue, err = h.resolveValue(ctx, detail, value); err != nil {
+				item.NewValue = lookupFallback(ctx, detail, value, err)
 			}
 		}
+		if detail.Property == "attachment" && detail.Value != nil {
+			item.URL = fmt.Sprintf("%sattachments/%v", h.config.RedmineHost, detail.PropKey)
+		}
+		resolved = append(resolved, item)
+	}
+	return resolved
+}
 
-		journalDetail := JournalDetail{
-			OldValue:   oldValue,
-			NewValue:   newValue,
-			Name:       fieldName,
-			DetailType: detailType,
+func (h *IssuesHandler) journalDetails(resolved []resolvedDetail, lang string) (details []JournalDetail) {
+	for _, item := range resolved {
+		name := item.Name
+		if name == "" {
+			name = h.getFieldName(item.Detail, lang)
 		}
-		data.Journals = append(data.Journals, journalDetail)
+		details = append(details, JournalDetail{
+			OldValue:   truncateText(journalValueLimit, item.OldValue),
+			NewValue:   truncateText(journalValueLimit, item.NewValue),
+			Name:       name,
+			DetailType: h.getDetailType(item.Detail),
+			URL:        item.URL,
+		})
 	}
-	return nil
+	return details
 }
 
-func (h *IssuesHandler) buildKeyboard(issue RedmineRequest) *tgbotapi.InlineKeyboardMarkup {
+func (h *IssuesHandler) buildKeyboard(issue RedmineRequest, lang string) *tgbotapi.InlineKeyboardMarkup {
 	urlButtons := []tgbotapi.InlineKeyboardButton{}
 	urlButtons = append(urlButtons, tgbotapi.NewInlineKeyboardButtonURL(
-		"Открыть заявку в браузере",
+		h.i18n.T(lang, "keyboard.open"),
 		fmt.Sprintf("%sissues/%d", h.config.RedmineHost, issue.Payload.Issue.ID),
 	))
 	if issue.Payload.Issue.Status.ID == 1 {
 		urlButtons = append(urlButtons, tgbotapi.NewInlineKeyboardButtonData(
-			"Подтвердить заявку",
+			h.i18n.T(lang, "keyboard.confirm"),
 			strconv.Itoa(9)+strconv.Itoa(issue.Payload.Issue.ID),
 		))
 		urlButtons = append(urlButtons, tgbotapi.NewInlineKeyboardButtonData(
-			"Отклонить заявку",
+			h.i18n.T(lang, "keyboard.reject"),
 			strconv.Itoa(6)+strconv.Itoa(issue.Payload.Issue.ID),
 		))
 	}
 	if issue.Payload.Issue.Status.ID == 9 {
 		urlButtons = append(urlButtons, tgbotapi.NewInlineKeyboardButtonData(
-			"Закрыть заявку",
+			h.i18n.T(lang, "keyboard.close"),
 			strconv.Itoa(5)+strconv.Itoa(issue.Payload.Issue.ID),
 		))
 	}
@@ -230,190 +408,278 @@ func (h *IssuesHandler) buildKeyboard(issue RedmineRequest) *tgbotapi.InlineKeyb
 	return &Kb
 }
 
-func (h *IssuesHandler) getAdminsForNotifications(projectID int) (admins []*User, err error) {
-	_admins, err := GetAdmins(h.db)
-	if err != nil {
-		return nil, err
-	}
-
-	_members, err := h.redmine.GetMembershipsByProject(projectID)
+func (h *IssuesHandler) renderTemplate(lang string, data *TemplateData) (notification string, err error) {
+	return h.templates.RenderLocalized(staffTemplate, lang, data)
+}
 
-	if err != nil {
-		return nil, err
+// buildTemplateData collects staff template data from the enriched event
+func (h *IssuesHandler) buildTemplateData(event *IssueEvent, lang string) TemplateData {
+	issue := event.Request.Payload.Issue
+	journal := event.Request.Payload.Journal
+	data := TemplateData{
+		Project:     issue.Project.Name,
+		IssueID:     issue.ID,
+		Subject:     issue.Subject,
+		Assignee:    issue.Assignee.FullName(),
+		Description: issue.Description,
+		Status:      issue.Status.Name,
+		Action:      event.Request.Payload.ActionName(h.i18n, lang),
+		CreatedOn:   issue.CreatedOn,
+		UpdatedOn:   issue.UpdatedOn,
+		PhoneNumber: customFieldValue(issue, clientPhoneField),
+		Address:     customFieldValue(issue, clientAddressField),
+		Journals:    h.journalDetails(event.Details, lang),
 	}
 
-	members := make(map[int]RedmineUser)
-	for _, member := range _members.Users {
-		members[member.User.ID] = member.User
+	if event.Request.Payload.Action == "updated" {
+		data.Notes = journal.Notes
+		data.Author = journal.Author.FullName()
 	}
+	return data
+}
 
-	for _, admin := range _admins {
-		if _, ok := members[int(admin.RedmineID)]; ok {
-			admins = append(admins, admin)
-		}
+// buildClientTemplateData ...
+func (h *IssuesHandler) buildClientTemplateData(event *IssueEvent) ClientTemplateData {
+	issue := event.Request.Payload.Issue
+	return ClientTemplateData{
+		IssueID:  issue.ID,
+		StatusID: issue.Status.ID,
+		Status:   issue.Status.Name,
+		Subject:  issue.Subject,
+		Phone:    event.ClientPhone,
 	}
+}
 
-	return admins, nil
+// Shutdown stops Run and waits for the workers until ctx is done
+func (h *IssuesHandler) Shutdown(ctx context.Context) error {
+	h.closeOnce.Do(func() { close(h.closeChan) })
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (h *IssuesHandler) renderTemplate(data *TemplateData) (notification string, err error) {
-	var t bytes.Buffer
+type AuthHandler struct {
+	config Config
+	store  Store
+	bot    Messenger
+	i18n   *Translator
+	rules  *RuleResolver
+
+	// Language chosen before the user shared the phone number
+	mu        sync.Mutex
+	languages map[int64]string
+}
 
-	tmpl, err := getTemplate(h.config)
-	if err != nil {
-		fmt.Println(err)
-		return
+func NewAuthHandler(config Config, store Store, bot Messenger, i18n *Translator, rules *RuleResolver) *AuthHandler {
+	return &AuthHandler{
+		config:    config,
+		bot:       bot,
+		store:     store,
+		i18n:      i18n,
+		rules:     rules,
+		languages: make(map[int64]string),
 	}
-	tmpl.Execute(&t, data)
-	notification = t.String()
-
-	return notification, nil
 }
 
-func (h *IssuesHandler) sendNotifications(issue RedmineRequest) {
-	journal := issue.Payload.Journal
-	data := TemplateData{
-		Project:     issue.Payload.Issue.Project.Name,
-		IssueID:     issue.Payload.Issue.ID,
-		Subject:     issue.Payload.Issue.Subject,
-		Assignee:    issue.Payload.Issue.Assignee.FullName(),
-		Description: issue.Payload.Issue.Description,
-		Status:      issue.Payload.Issue.Status.Name,
-		Action:      issue.Payload.ActionName(),
+const languageCallbackPrefix = "lang:"
+
+// language returns the user's language, a language picked before authorization
+// or the language of the Telegram client
+func (ah *AuthHandler) language(chatID int64, from *tgbotapi.User) string {
+	if user, err := ah.store.GetUserByChatID(chatID); err == nil && user.Language != "" {
+		return ah.i18n.Language(user.Language)
 	}
+	ah.mu.Lock()
+	lang, ok := ah.languages[chatID]
+	ah.mu.Unlock()
+	if ok {
+		return lang
+	}
+	if from != nil {
+		return ah.i18n.Language(from.LanguageCode)
+	}
+	return ah.i18n.Language("")
+}
 
-	if issue.Payload.Action == "updated" {
-		data.Notes = journal.Notes
-		data.Author = journal.Author.FullName()
+func (ah *AuthHandler) languageKeyboard() tgbotapi.InlineKeyboardMarkup {
+	var row []tgbotapi.InlineKeyboardButton
+	for _, lang := range ah.i18n.Languages() {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(
+			ah.i18n.T(lang, "language.name"),
+			languageCallbackPrefix+lang,
+		))
 	}
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
 
-	numPhone, address, errNum := h.redmine.GetClientDataFromCustomFields(issue.Payload.Issue.ID)
-	if errNum != nil {
-		fmt.Println("Num Phone Error: ", errNum)
+func (ah *AuthHandler) sendAuthPrompt(chatID int64, lang string) {
+	kb := tgbotapi.NewReplyKeyboard(
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButtonContact(ah.i18n.T(lang, "auth.button")),
+		),
+	)
+	newMessage := tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "auth.prompt"))
+	newMessage.ReplyMarkup = kb
+	ah.bot.Send(newMessage)
+}
+
+func (ah *AuthHandler) Authenticate(message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	if err := ah.store.ResetChatUnavailable(chatID); err != nil {
+		logger.Error("chat reset failed", "chat", chatID, "err", err)
+	}
+	lang := ah.language(chatID, message.From)
+	if message.IsCommand() && message.Command() == "start" {
+		ah.sendAuthPrompt(chatID, lang)
+		if len(ah.i18n.Languages()) > 1 {
+			newMessage := tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "auth.choose_language"))
+			newMessage.ReplyMarkup = ah.languageKeyboard()
+			ah.bot.Send(newMessage)
+		}
 		return
 	}
-	data.PhoneNumber = numPhone;
-	data.Address = address;
-
-	err := h.fillJournalDetails(journal.Details, &data)
-	if err != nil {
-		fmt.Println(err)
+	if message.IsCommand() && message.Command() == "settings" {
+		ah.showSettings(message, lang)
 		return
 	}
-
-	resultMsg, err := h.renderTemplate(&data)
-	if err != nil {
-		fmt.Println(err)
+	if message.IsCommand() && message.Command() == "quiet" {
+		ah.setQuietHours(message, lang)
 		return
 	}
-
-	phones := issue.GetUserPhones()
-	users, err := FindUsersByPhone(h.db, phones)
-	if err == gorm.ErrRecordNotFound {
-		fmt.Println(err)
+	if message.IsCommand() && message.Command() == "rules" {
+		ah.showRules(message, lang)
 		return
 	}
-	if issue.Payload.Action == "opened" {
-		admins, err := h.getAdminsForNotifications(issue.Payload.Issue.Project.ID)
+	if message.Contact != nil && message.Contact.UserID == userID {
+		phoneNumber := strings.ReplaceAll(message.Contact.PhoneNumber, "+", "")
+		_, err := ah.store.GetOrCreateUser(chatID, userID, phoneNumber, lang)
 		if err != nil {
-			fmt.Println(err)
+			logger.Error("user registration failed", "chat", chatID, "err", err)
 			return
 		}
-		users = append(users, admins...)
+		logger.Info("user registered", "chat", chatID, "tg_user", userID)
+		ah.mu.Lock()
+		delete(ah.languages, chatID)
+		ah.mu.Unlock()
+		newMessage := tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "auth.success"))
+		newMessage.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+		ah.bot.Send(newMessage)
+		return
 	}
+}
 
-	uniqueUsers := make(map[uint]*User)
-	for _, user := range users {
-		if _, ok := uniqueUsers[user.ID]; !ok {
-			uniqueUsers[user.ID] = user
-		}
+func (ah *AuthHandler) showSettings(message *tgbotapi.Message, lang string) {
+	chatID := message.Chat.ID
+	if _, err := ah.store.GetUserByChatID(chatID); err != nil {
+		ah.bot.Send(tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "auth.required")))
+		return
 	}
+	newMessage := tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "settings.title", ah.i18n.T(lang, "language.name")))
+	newMessage.ReplyMarkup = ah.languageKeyboard()
+	ah.bot.Send(newMessage)
+}
 
-	kb := h.buildKeyboard(issue)
-	for _, user := range uniqueUsers {
-		jsonStr, err := json.Marshal(issue)
-		if err != nil {
-			fmt.Println(err)
-		}
-		respData := bytes.NewBuffer(jsonStr)
-		jsonToModel := respData.String()
-		message := tgbotapi.NewMessage(user.Chat, resultMsg)
-		message.ParseMode = "html"
-		message.ReplyMarkup = kb
-		h.bot.Send(message)
-		jsMsg, err := GetOrCreateMessage(h.db, user.TGUser, issue.Payload.Issue.Status.Name, issue.Payload.Issue.Subject, user.Phone, true, true, jsonToModel)
-		jsonStrMsg, err := json.Marshal(jsMsg)
-		if err != nil {
-			fmt.Println(err)
+// SetLanguage handles language buttons from /start and /settings
+func (ah *AuthHandler) SetLanguage(query *tgbotapi.CallbackQuery) {
+	ah.bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
+	if query.Message == nil {
+		return
+	}
+	chatID := query.Message.Chat.ID
+	lang := ah.i18n.Language(strings.TrimPrefix(query.Data, languageCallbackPrefix))
+
+	user, err := ah.store.GetUserByChatID(chatID)
+	if err == nil {
+		if err := ah.store.UpdateUserLanguage(user, lang); err != nil {
+			logger.Error("language update failed", "chat", chatID, "err", err)
 			return
 		}
-		jMsg := bytes.NewBuffer(jsonStrMsg)
-		byteValue, _ := ioutil.ReadAll(jMsg)
-	
-		var reqMsg Message
-	
-		json.Unmarshal([]byte(byteValue), &reqMsg)
-		if err != nil {
-			fmt.Println("Error Notification:",err)
-		} else {
-			_, err := UpdateApplySendStatus(h.db, reqMsg)			
-			if err != nil {
-				fmt.Println(">> ADMIN - Update is failed:", err)
-			}
-		}
+	} else {
+		ah.mu.Lock()
+		ah.languages[chatID] = lang
+		ah.mu.Unlock()
 	}
-	return
-}
 
-// Stop ...
-func (h *IssuesHandler) Stop() {
-	h.closeChan <- 0
+	ah.bot.Send(tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "settings.language_set", ah.i18n.T(lang, "language.name"))))
+	if err != nil {
+		ah.sendAuthPrompt(chatID, lang)
+	}
 }
 
-type AuthHandler struct {
-	config Config
-	db     *gorm.DB
-	bot    *tgbotapi.BotAPI
-}
+// setQuietHours handles "/quiet [HH:MM HH:MM [timezone] | off | default]"
+func (ah *AuthHandler) setQuietHours(message *tgbotapi.Message, lang string) {
+	chatID := message.Chat.ID
+	user, err := ah.store.GetUserByChatID(chatID)
+	if err != nil {
+		ah.bot.Send(tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "auth.required")))
+		return
+	}
 
-func NewAuthHandler(config Config, db *gorm.DB, bot *tgbotapi.BotAPI) *AuthHandler {
-	return &AuthHandler{
-		config: config,
-		bot:    bot,
-		db:     db,
+	args := strings.Fields(message.CommandArguments())
+	start, end, timezone := user.QuietStart, user.QuietEnd, user.Timezone
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "off":
+		start, end, timezone = "00:00", "00:00", ""
+	case len(args) == 1 && args[0] == "default":
+		start, end, timezone = "", "", ""
+	case len(args) == 2 || len(args) == 3:
+		start, end, timezone = args[0], args[1], ""
+		if len(args) == 3 {
+			timezone = args[2]
+		}
+		if _, err := newQuietWindow(start, end, timezone); err != nil {
+			ah.bot.Send(tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "quiet.invalid")))
+			return
+		}
+	default:
+		ah.bot.Send(tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "quiet.usage")))
+		return
+	}
+
+	if len(args) > 0 {
+		if err := ah.store.UpdateUserQuietHours(user, start, end, timezone); err != nil {
+			logger.Error("quiet hours update failed", "chat", chatID, "err", err)
+			return
+		}
+	}
+
+	if start == "" && end == "" {
+		start, end, timezone = ah.config.QuietHours.Start, ah.config.QuietHours.End, ah.config.QuietHours.Timezone
+	} else if timezone == "" {
+		timezone = ah.config.QuietHours.Timezone
+	}
+	text := ah.i18n.T(lang, "quiet.disabled")
+	if window, err := newQuietWindow(start, end, timezone); err == nil && window != nil {
+		text = ah.i18n.T(lang, "quiet.current", start, end, window.location)
 	}
+	ah.bot.Send(tgbotapi.NewMessage(chatID, text))
 }
 
-func (ah *AuthHandler) Authenticate(message *tgbotapi.Message) {
+// showRules handles "/rules <issue id>", admins only
+func (ah *AuthHandler) showRules(message *tgbotapi.Message, lang string) {
 	chatID := message.Chat.ID
-	userID := message.From.ID
-	if message.IsCommand() && message.Command() == "start" {
-		kb := tgbotapi.NewReplyKeyboard(
-			tgbotapi.NewKeyboardButtonRow(
-				tgbotapi.NewKeyboardButtonContact("Авторизоваться"),
-			),
-		)
-		newMessage := tgbotapi.NewMessage(
-			message.Chat.ID,
-			"Для авторизации необходим номер телефона.\n\nДля того, чтобы отправить его, необходимо нажать на кнопку 'Авторизация'.",
-		)
-		newMessage.ReplyMarkup = kb
-		ah.bot.Send(newMessage)
+	user, err := ah.store.GetUserByChatID(chatID)
+	if err != nil || !user.IsAdmin {
+		ah.bot.Send(tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "rules.admin_only")))
 		return
 	}
-	if message.Contact != nil && message.Contact.UserID == userID {
-		phoneNumber := strings.ReplaceAll(message.Contact.PhoneNumber, "+", "")
-		_, err := GetOrCreateUser(ah.db, chatID, userID, phoneNumber)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		newMessage := tgbotapi.NewMessage(
-			chatID,
-			"Вы успешно авторизованы.\n\nТеперь Вы сможете получать уведомления по заявкам и отправлять фото о проделаной работе!",
-		)
-		newMessage.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-		ah.bot.Send(newMessage)
+	issueID, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(message.CommandArguments()), "#"))
+	if err != nil {
+		ah.bot.Send(tgbotapi.NewMessage(chatID, ah.i18n.T(lang, "rules.usage")))
 		return
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	text, err := ah.rules.Explain(ctx, issueID, lang)
+	if err != nil {
+		logger.Error("rules explanation failed", "issue", issueID, "err", err)
+		text = ah.i18n.T(lang, "rules.error", issueID)
+	}
+	ah.bot.Send(tgbotapi.NewMessage(chatID, text))
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// HealthCheck - result of one readiness check
+type HealthCheck struct {
+	Status    string  `json:"status"` // "ok" or "fail"
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ReadinessReport - body of /readyz
+type ReadinessReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// HealthChecker serves /healthz (the process answers) and /readyz
+// (database, Redmine, Telegram and the event queue are usable)
+type HealthChecker struct {
+	store    Store
+	redmine  IssueTracker
+	bot      Messenger
+	maxQueue int
+	timeout  time.Duration
+}
+
+// NewHealthChecker ...
+func NewHealthChecker(config Config, store Store, redmine IssueTracker, bot Messenger) *HealthChecker {
+	maxQueue := config.Health.MaxQueueDepth
+	if maxQueue <= 0 {
+		maxQueue = 100
+	}
+	return &HealthChecker{
+		store:    store,
+		redmine:  redmine,
+		bot:      bot,
+		maxQueue: maxQueue,
+		timeout:  5 * time.Second,
+	}
+}
+
+// Register adds the endpoints to the HTTP server
+func (hc *HealthChecker) Register(e *echo.Echo) {
+	e.GET("/healthz", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+	})
+	e.GET("/readyz", func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), hc.timeout)
+		defer cancel()
+		report := hc.Ready(ctx)
+		status := http.StatusOK
+		if report.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		return c.JSON(status, report)
+	})
+}
+
+// Ready runs all checks concurrently
+func (hc *HealthChecker) Ready(ctx context.Context) ReadinessReport {
+	checks := map[string]func(ctx context.Context) error{
+		"database": func(ctx context.Context) error {
+			return hc.store.Ping()
+		},
+		// Statuses are cached, so a healthy Redmine is asked once an hour
+		"redmine": func(ctx context.Context) error {
+			_, err := hc.redmine.GetIssueStatuses(ctx)
+			return err
+		},
+		"telegram": func(ctx context.Context) error {
+			_, err := hc.bot.MakeRequest("getMe", nil)
+			return err
+		},
+		// Events that don't fit the in-memory queue wait in the database,
+		// so the backlog is counted there
+		"queue": func(ctx context.Context) error {
+			depth, err := hc.store.CountPendingWebhookEvents()
+			if err != nil {
+				return err
+			}
+			if depth >= hc.maxQueue {
+				return fmt.Errorf("%d events are not processed, limit %d", depth, hc.maxQueue)
+			}
+			return nil
+		},
+	}
+
+	report := ReadinessReport{Status: "ok", Checks: make(map[string]HealthCheck)}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			started := time.Now()
+			err := runCheck(ctx, check)
+			result := HealthCheck{Status: "ok", LatencyMS: float64(time.Since(started).Microseconds()) / 1000}
+			if err != nil {
+				result.Status, result.Error = "fail", err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if err != nil {
+				report.Status = "fail"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
+
+// runCheck gives up on the check when ctx is done, the Telegram client
+// can't be cancelled
+func runCheck(ctx context.Context, check func(ctx context.Context) error) error {
+	result := make(chan error, 1)
+	go func() { result <- check(ctx) }()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runHealthcheck asks /readyz of the running bot, for the container healthcheck.
+// The address comes from the config, so the check follows WebhookHost and
+// WebhookPort and the image needs no HTTP client.
+func runHealthcheck(config Config) error {
+	host := config.WebhookHost
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, strconv.Itoa(config.WebhookPort)) + "/readyz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("readyz answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// healthTracker answers the redmine check
+type healthTracker struct {
+	IssueTracker
+	err error
+}
+
+func (h healthTracker) GetIssueStatuses(ctx context.Context) (*IssueStatusesResponse, error) {
+	return new(IssueStatusesResponse), h.err
+}
+
+// healthBot answers the telegram check
+type healthBot struct {
+	Messenger
+	err error
+}
+
+func (h healthBot) MakeRequest(endpoint string, params url.Values) (tgbotapi.APIResponse, error) {
+	return tgbotapi.APIResponse{Ok: h.err == nil}, h.err
+}
+
+func TestReady(t *testing.T) {
+	down := errors.New("down")
+	tests := []struct {
+		name     string
+		redmine  error
+		telegram error
+		pending  int
+		status   string
+		failed   string
+	}{
+		{"all ok", nil, nil, 0, "ok", ""},
+		{"redmine down", down, nil, 0, "fail", "redmine"},
+		{"telegram down", nil, down, 0, "fail", "telegram"},
+		{"backlog in the database", nil, nil, 3, "fail", "queue"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			for i := 0; i < tt.pending; i++ {
+				if _, err := store.CreateWebhookEvent(100+i, "opened", 0, "webhook", "", "{}"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var config Config
+			config.Health.MaxQueueDepth = 3
+			hc := NewHealthChecker(config, store, healthTracker{err: tt.redmine}, healthBot{err: tt.telegram})
+			report := hc.Ready(context.Background())
+			if report.Status != tt.status {
+				t.Errorf("status %s, want %s: %+v", report.Status, tt.status, report.Checks)
+			}
+			for name, check := range report.Checks {
+				if want := name == tt.failed; (check.Status == "fail") != want {
+					t.Errorf("check %s: %s %s", name, check.Status, check.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestRunHealthcheck(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/readyz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	var config Config
+	config.WebhookHost = "0.0.0.0"
+	config.WebhookPort, _ = strconv.Atoi(port)
+	if err := runHealthcheck(config); err != nil {
+		t.Errorf("ready bot: %v", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := runHealthcheck(config); err == nil {
+		t.Error("not ready bot: no error")
+	}
+}
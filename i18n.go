@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	toml "github.com/BurntSushi/toml"
+)
+
+// Translator - message catalogs loaded from <LocalesDir>/<lang>.toml
+type Translator struct {
+	catalogs map[string]map[string]string
+	fallback string
+}
+
+func flattenCatalog(prefix string, values map[string]interface{}, catalog map[string]string) {
+	for key, value := range values {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenCatalog(prefix+key+".", v, catalog)
+		case string:
+			catalog[prefix+key] = v
+		}
+	}
+}
+
+// LoadTranslator reads every catalog in dir, fallback language must be present
+func LoadTranslator(dir string, fallback string) (*Translator, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Translator{
+		catalogs: make(map[string]map[string]string),
+		fallback: fallback,
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".toml" {
+			continue
+		}
+		var values map[string]interface{}
+		if _, err := toml.DecodeFile(filepath.Join(dir, file.Name()), &values); err != nil {
+			return nil, fmt.Errorf("%s: %v", file.Name(), err)
+		}
+		catalog := make(map[string]string)
+		flattenCatalog("", values, catalog)
+		t.catalogs[strings.TrimSuffix(file.Name(), ".toml")] = catalog
+	}
+	if _, ok := t.catalogs[fallback]; !ok {
+		return nil, fmt.Errorf("catalog for default language %q not found in %s", fallback, dir)
+	}
+	return t, nil
+}
+
+// Languages returns codes of loaded catalogs, default language first
+func (t *Translator) Languages() []string {
+	languages := []string{t.fallback}
+	for lang := range t.catalogs {
+		if lang != t.fallback {
+			languages = append(languages, lang)
+		}
+	}
+	sort.Strings(languages[1:])
+	return languages
+}
+
+// Language returns lang if it has a catalog, otherwise the default language
+func (t *Translator) Language(lang string) string {
+	if _, ok := t.catalogs[lang]; ok {
+		return lang
+	}
+	return t.fallback
+}
+
+// T translates key, args are applied with fmt.Sprintf.
+// Missing keys fall back to the default language and then to the key itself.
+func (t *Translator) T(lang string, key string, args ...interface{}) string {
+	text, ok := t.catalogs[lang][key]
+	if !ok {
+		text, ok = t.catalogs[t.fallback][key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// Has reports whether key exists in lang or default catalog
+func (t *Translator) Has(lang string, key string) bool {
+	if _, ok := t.catalogs[lang][key]; ok {
+		return true
+	}
+	_, ok := t.catalogs[t.fallback][key]
+	return ok
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel - minimal level of written records, set with Config.LogLevel
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	return levelNames[l]
+}
+
+// parseLogLevel accepts "debug", "info", "warn" and "error"
+func parseLogLevel(value string) (LogLevel, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(value, name) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", value)
+}
+
+const redacted = "[REDACTED]"
+
+// minEmbeddedSecret - shorter secrets are redacted only as whole values,
+// replacing them inside text would mangle unrelated words
+const minEmbeddedSecret = 8
+
+// sensitiveKeys - values of these keys and keys ending with "_<key>" are
+// always redacted
+var sensitiveKeys = []string{"token", "password", "secret"}
+
+// logOutput - writer shared by a logger and the loggers derived with With
+type logOutput struct {
+	mu       sync.Mutex
+	w        io.Writer
+	level    LogLevel
+	json     bool
+	secrets  map[string]bool
+	redactor *strings.Replacer
+}
+
+// redact hides secrets in the value of key
+func (o *logOutput) redact(key string, value string) string {
+	lower := strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if lower == sensitive || strings.HasSuffix(lower, "_"+sensitive) {
+			return redacted
+		}
+	}
+	if o.secrets[value] {
+		return redacted
+	}
+	return o.redactor.Replace(value)
+}
+
+// Logger writes one logfmt or JSON record per line. Values of keys like
+// "token" or "password", values equal to a configured secret and secrets of
+// at least minEmbeddedSecret characters inside values are redacted.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// logger - the process logger, replaced by initLogger
+var logger = NewLogger(os.Stderr, LevelInfo, "logfmt", nil)
+
+// NewLogger ...
+func NewLogger(w io.Writer, level LogLevel, format string, secrets []string) *Logger {
+	var pairs []string
+	whole := make(map[string]bool)
+	// Longer secrets first, so a secret containing another one is hidden whole
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		whole[secret] = true
+		if len(secret) >= minEmbeddedSecret {
+			pairs = append(pairs, secret, redacted)
+		}
+	}
+	return &Logger{out: &logOutput{
+		w:        w,
+		level:    level,
+		json:     format == "json",
+		secrets:  whole,
+		redactor: strings.NewReplacer(pairs...),
+	}}
+}
+
+// initLogger sets up the process logger from the config
+func initLogger(config Config) error {
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	logger = NewLogger(os.Stderr, level, config.LogFormat, configSecrets(config))
+	return nil
+}
+
+// configSecrets - config values that must never reach the log
+func configSecrets(config Config) []string {
+	secrets := []string{
+		config.TgToken,
+		config.RedmineToken,
+		config.Proxy.Password,
+		config.Telegram.SecretToken,
+		config.Dashboard.Password,
+	}
+	return append(secrets, config.Admin.Tokens...)
+}
+
+// With returns a logger adding keyvals to every record
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled reports whether records of the level are written
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.out.level
+}
+
+// Debug ...
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+
+// Info ...
+func (l *Logger) Info(msg string, keyvals ...interface{}) { l.log(LevelInfo, msg, keyvals) }
+
+// Warn ...
+func (l *Logger) Warn(msg string, keyvals ...interface{}) { l.log(LevelWarn, msg, keyvals) }
+
+// Error ...
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+// Fatal logs at error level and exits
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.Error(msg, keyvals...)
+	os.Exit(1)
+}
+
+// Println and Printf let tgbotapi log through the logger at debug level
+func (l *Logger) Println(v ...interface{}) {
+	l.Debug(strings.TrimSpace(fmt.Sprintln(v...)), "component", "tgbotapi")
+}
+
+// Printf ...
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.Debug(strings.TrimSpace(fmt.Sprintf(format, v...)), "component", "tgbotapi")
+}
+
+func (l *Logger) log(level LogLevel, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	keys := []string{"time", "level", "msg"}
+	values := []string{time.Now().Format(time.RFC3339Nano), level.String(), l.out.redact("msg", msg)}
+	all := append(append([]interface{}{}, l.fields...), keyvals...)
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		value := "!MISSING"
+		if i+1 < len(all) {
+			value = formatLogValue(all[i+1])
+		}
+		keys = append(keys, key)
+		values = append(values, l.out.redact(key, value))
+	}
+
+	var line strings.Builder
+	if l.out.json {
+		line.WriteByte('{')
+		for idx, key := range keys {
+			if idx > 0 {
+				line.WriteByte(',')
+			}
+			encodedKey, _ := json.Marshal(key)
+			encodedValue, _ := json.Marshal(values[idx])
+			line.Write(encodedKey)
+			line.WriteByte(':')
+			line.Write(encodedValue)
+		}
+		line.WriteByte('}')
+	} else {
+		for idx, key := range keys {
+			if idx > 0 {
+				line.WriteByte(' ')
+			}
+			line.WriteString(key)
+			line.WriteByte('=')
+			line.WriteString(logfmtQuote(values[idx]))
+		}
+	}
+	line.WriteByte('\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	io.WriteString(l.out.w, line.String())
+}
+
+func formatLogValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case time.Duration:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+func logfmtQuote(value string) string {
+	if value == "" || strings.ContainsAny(value, " \"=\\\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+type loggerKey struct{}
+type correlationKey struct{}
+
+// withCorrelationID ties ctx and the records logged through it to one webhook
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, correlationKey{}, id)
+	return context.WithValue(ctx, loggerKey{}, loggerFrom(ctx).With("cid", id))
+}
+
+// correlationID - id set by withCorrelationID, "" if there is none
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// loggerFrom - logger carrying the fields of ctx, the process logger by default
+func loggerFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// newCorrelationID - random id of a webhook
+func newCorrelationID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// withLogFields adds keyvals to the records logged through ctx
+func withLogFields(ctx context.Context, keyvals ...interface{}) context.Context {
+	return context.WithValue(ctx, loggerKey{}, loggerFrom(ctx).With(keyvals...))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLoggerRedaction(t *testing.T) {
+	secrets := []string{"123456:telegram-bot-token", "redmine-api-key", "abc", ""}
+	tests := []struct {
+		name    string
+		msg     string
+		keyvals []interface{}
+		hidden  []string
+		visible []string
+	}{
+		{"long secret inside a value", "request failed", []interface{}{"url", "https://api.telegram.org/bot123456:telegram-bot-token/getMe"},
+			[]string{"telegram-bot-token"}, []string{"https://api.telegram.org/bot[REDACTED]/getMe"}},
+		{"long secret in the message", "key redmine-api-key rejected", nil,
+			[]string{"redmine-api-key"}, []string{"key [REDACTED] rejected"}},
+		{"short secret as a whole value", "login", []interface{}{"user", "abc"},
+			[]string{"user=abc"}, []string{"user=[REDACTED]"}},
+		{"short secret inside text is kept", "fabric abcd", []interface{}{"path", "/abc/def"},
+			nil, []string{"fabric abcd", "path=/abc/def"}},
+		{"sensitive keys", "config", []interface{}{"token", "x", "secret_token", "y", "token_id", 2},
+			[]string{"token=x", "secret_token=y"}, []string{"token=[REDACTED]", "secret_token=[REDACTED]", "token_id=2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			NewLogger(&out, LevelDebug, "logfmt", secrets).Info(tt.msg, tt.keyvals...)
+			line := out.String()
+			for _, text := range tt.hidden {
+				if strings.Contains(line, text) {
+					t.Errorf("%q is logged: %s", text, line)
+				}
+			}
+			for _, text := range tt.visible {
+				if !strings.Contains(line, text) {
+					t.Errorf("%q is missing: %s", text, line)
+				}
+			}
+		})
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	tests := []struct {
+		value string
+		level LogLevel
+		debug bool
+		ok    bool
+	}{
+		{"debug", LevelDebug, true, true},
+		{"DEBUG", LevelDebug, true, true},
+		{"Info", LevelInfo, false, true},
+		{"warn", LevelWarn, false, true},
+		{"verbose", LevelInfo, false, false},
+	}
+	for _, tt := range tests {
+		level, err := parseLogLevel(tt.value)
+		if (err == nil) != tt.ok || level != tt.level {
+			t.Errorf("parseLogLevel(%q) = %v, %v", tt.value, level, err)
+		}
+		if debug := (Config{LogLevel: tt.value}).debug(); debug != tt.debug {
+			t.Errorf("debug() with LogLevel %q = %v, want %v", tt.value, debug, tt.debug)
+		}
+	}
+}
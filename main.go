@@ -8,18 +8,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"time"
-	"encoding/json"
-	"bytes"
-	"io/ioutil"
 	"strconv"
 	"sync"
+	"time"
+	_ "time/tzdata"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func initTgBot(config Config) (*tgbotapi.BotAPI, tgbotapi.UpdatesChannel) {
+func initTgBot(config Config) (*tgbotapi.BotAPI, UpdateSource) {
 	var (
 		bot *tgbotapi.BotAPI
 		err error
@@ -38,182 +37,214 @@ func initTgBot(config Config) (*tgbotapi.BotAPI, tgbotapi.UpdatesChannel) {
 		bot, err = tgbotapi.NewBotAPI(config.TgToken)
 	}
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	if config.Debug == "true" {
-		bot.Debug = true
-	}
-
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-
-	updates, err := bot.GetUpdatesChan(u)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return bot, updates
-}
-
-func clientMakeRequest(message *RedmineRequest,handler *IssuesHandler) {
-	jsonStr, err := json.Marshal(message)
-	if err != nil {
-		fmt.Println(err)
-		return
+		logger.Fatal("telegram bot failed", "err", err)
 	}
+	bot.Debug = config.debug()
 
-	payload := bytes.NewBuffer(jsonStr)
-	byteValue, _ := ioutil.ReadAll(payload)
-    var req RedmineRequest
-
-	json.Unmarshal([]byte(byteValue), &req)
-	custom_fields, err := handler.redmine.GetAPIForCustomFields(req.Payload.Issue.ID) 
-	// Запуск тестового скрипта для проверки, есть ли в API настраиваемые поля
-	if err != nil {
-		fmt.Println("Custom Fields Error: ", err)
-	} else {
-		req.Payload.Issue.CustomFieldValues = custom_fields.Issue.CustomFieldValues
-	}
-	fmt.Println("Custom Fields:", req.Payload.Issue.CustomFieldValues)
-	var str_number string
-	var isGetNotification = false;
-	for _, custom_field := range req.Payload.Issue.CustomFieldValues {
-		if custom_field.ID == 19 {
-			buffer_number := []rune(custom_field.Value)
-			buffer_number[0] = '7'
-			str_number = string(buffer_number)
-		}
-		if (custom_field.ID == 23) && (custom_field.Value == strconv.Itoa(1)) {
-			isGetNotification = true;
-		}
+	if config.Telegram.Mode == "webhook" {
+		return bot, NewTelegramWebhook(bot, config.Telegram)
 	}
-	if (isGetNotification == true) && ((req.Payload.Action == "opened") || ((req.Payload.Issue.Status.ID == 5 || req.Payload.Issue.Status.ID == 6 || req.Payload.Issue.Status.ID == 9) && (req.Payload.Action == "updated"))) {
-		var phones = []string{str_number}
-		users, err := FindUsersByPhone(handler.db, phones)
-		if err != nil {
-			fmt.Println("Error Phone Number:", err)
-		}
-		uniqueUsers := make(map[uint]*User)
-		for _, user := range users {
-			if _, ok := uniqueUsers[user.ID]; !ok {
-				uniqueUsers[user.ID] = user
-			}
-		}
-		var resultMsg string
-		if (req.Payload.Issue.Status.ID == 1) {
-			resultMsg = "Ваша заявка №"+strconv.Itoa(req.Payload.Issue.ID)+" была создана!\n\nСтатус: Открыта\nУслуга: Поверка счетчиков\nНомер телефона: +"+str_number+"\n\nСкоро Ваша заявка будет рассмотрена специалистом!"
-		}
-		if (req.Payload.Issue.Status.ID == 5) {
-			resultMsg = "Ваша заявка №"+strconv.Itoa(req.Payload.Issue.ID)+" была закрыта!\n\nСтатус: Закрыта\nУслуга: Поверка счетчиков\nНомер телефона: +"+str_number+"\n\nВаша заявка была сделана специалистом!\nЕсли Вы остались недовольны предоставленными услугами - позвоните нам."
-		}
-		if (req.Payload.Issue.Status.ID == 6) {
-			resultMsg = "Ваша заявка №"+strconv.Itoa(req.Payload.Issue.ID)+" была отклонена!\n\nСтатус: Отклонена\nУслуга: Поверка счетчиков\nНомер телефона: +"+str_number+"\n\nВаша заявка была отклонена специалистом!\nПопробуйте назначить другое время."
-		}
-		if (req.Payload.Issue.Status.ID == 9) {
-			resultMsg = "Ваша заявка №"+strconv.Itoa(req.Payload.Issue.ID)+" была подтверждена!\n\nСтатус: Подтверждена\nУслуга: Поверка счетчиков\nНомер телефона: +"+str_number+"\n\nВаша заявка была подтверждена специалистом!\nОжидайте мастера в назначенное Вами время."
-		}
-		jsonStr, err := json.Marshal(req)
-		if err != nil {
-			fmt.Println(err)
-		}
-		respData := bytes.NewBuffer(jsonStr)
-		jsonToModel := respData.String()
-		for _, user := range uniqueUsers {
-			if err != nil {
-				fmt.Println("Error Create Message:", err)
-			}
-			message := tgbotapi.NewMessage(user.Chat, resultMsg)
-			_, err := handler.bot.Send(message)
-			jsMsg, err := GetOrCreateMessage(handler.db, user.TGUser, req.Payload.Issue.Status.Name, req.Payload.Issue.Subject, str_number, false, true, jsonToModel)
-			jsonStrMsg, err := json.Marshal(jsMsg)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			jMsg := bytes.NewBuffer(jsonStrMsg)
-			byteValue, _ := ioutil.ReadAll(jMsg)
-		
-			var reqMsg Message
-		
-			json.Unmarshal([]byte(byteValue), &reqMsg)
-			if err != nil {
-				fmt.Println("Error Send Notification Client",err)
-			} else {
-				_, err := UpdateApplySendStatus(handler.db, reqMsg)			
-				if err != nil {
-					fmt.Println("USER - Update is failed!", err)
-				}
-			}
-		}
-	}
-	return
+	return bot, NewUpdatePoller(bot, 60)
 }
 
-func initHTTPServer(config Config, issuesUpdates chan RedmineRequest, handler *IssuesHandler) (*echo.Echo, string) {
+func initHTTPServer(config Config, handler *IssuesHandler, updates UpdateSource) (*echo.Echo, string) {
 	e := echo.New()
 	e.POST("/webhook", func(c echo.Context) error {
+		// The id of a proxy in front of the bot is kept, so records can be matched
+		cid := c.Request().Header.Get(echo.HeaderXRequestID)
+		if cid == "" || len(cid) > 64 {
+			cid = newCorrelationID()
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, cid)
+		ctx := withCorrelationID(c.Request().Context(), cid)
+
 		redmineRequest := new(RedmineRequest)
 		if err := c.Bind(redmineRequest); err != nil {
+			webhooksTotal.WithLabelValues("", "bad_request").Inc()
+			loggerFrom(ctx).Warn("bad webhook", "err", err)
 			return err
 		}
-		clientMakeRequest(redmineRequest,handler)
-		issuesUpdates <- *redmineRequest
+		// Redmine retries failed webhooks, so answer only after the event is stored
+		if err := handler.Enqueue(ctx, redmineRequest); err != nil {
+			loggerFrom(ctx).Error("webhook failed", "err", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 
 		return c.NoContent(http.StatusOK)
 	})
-	if config.Debug == "true" {
-		e.Debug = true
+	if webhook, ok := updates.(*TelegramWebhook); ok {
+		e.POST(config.Telegram.WebhookPath, webhook.Handle)
 	}
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	e.Debug = config.debug()
 	bindURL := fmt.Sprintf("%s:%d", config.WebhookHost, config.WebhookPort)
 	return e, bindURL
 }
 
+// newDispatcher routes Telegram updates: keyboard buttons, group and bot commands
+func newDispatcher(config Config, redmine IssueTracker, sender *Sender, authHandler *AuthHandler, groupHandler *GroupHandler) *Dispatcher {
+	d := NewDispatcher(config.UpdateWorkers, config.QueueSize)
+	d.HandleCallback(fullTextCallbackPrefix, func(update TelegramUpdate) {
+		callbacksTotal.WithLabelValues("full_text").Inc()
+		if err := sender.SendFullText(update.CallbackQuery); err != nil {
+			logger.Error("full text failed", "update", update.UpdateID, "err", err)
+		}
+	})
+	d.HandleCallback(languageCallbackPrefix, func(update TelegramUpdate) {
+		callbacksTotal.WithLabelValues("language").Inc()
+		authHandler.SetLanguage(update.CallbackQuery)
+	})
+	d.HandleCallback("", func(update TelegramUpdate) {
+		changeStatus(update.CallbackQuery, redmine, groupHandler, groupHandler.i18n)
+	})
+	d.HandleMessage(func(update TelegramUpdate) {
+		if groupHandler.Handle(update.Message, update.ThreadID) {
+			return
+		}
+		authHandler.Authenticate(update.Message)
+	})
+	return d
+}
+
+// statusNotes - locale keys of the journal notes added with the status buttons
+var statusNotes = map[int]string{
+	5: "status_note.closed",
+	6: "status_note.rejected",
+	9: "status_note.confirmed",
+}
+
+// changeStatus handles status buttons, data is the status id digit followed by the issue id.
+// Journal notes are written in the default language, they are read in Redmine.
+func changeStatus(query *tgbotapi.CallbackQuery, redmine IssueTracker, groupHandler *GroupHandler, i18n *Translator) {
+	log := logger.With("callback", query.ID)
+	data := []rune(query.Data)
+	if len(data) < 2 {
+		log.Warn("unknown callback data", "data", query.Data)
+		return
+	}
+	postStatusID, err := strconv.Atoi(string(data[0]))
+	if err != nil {
+		log.Warn("bad callback data", "data", query.Data, "err", err)
+		return
+	}
+	issueID, err := strconv.Atoi(string(data[1:]))
+	if err != nil {
+		log.Warn("bad callback data", "data", query.Data, "err", err)
+		return
+	}
+	log = log.With("issue", issueID, "status", postStatusID)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	allowed, err := groupHandler.CanChangeStatus(ctx, query, issueID)
+	if err != nil {
+		log.Error("permission check failed", "err", err)
+	}
+	if !allowed {
+		callbacksTotal.WithLabelValues("status_denied").Inc()
+		groupHandler.DenyCallback(query)
+		return
+	}
+	callbacksTotal.WithLabelValues("status").Inc()
+	notes := ""
+	if key, ok := statusNotes[postStatusID]; ok {
+		notes = i18n.T(i18n.Language(""), key)
+	}
+	res, err := redmine.UpdateStatusIssue(ctx, issueID, postStatusID, notes)
+	if err != nil {
+		log.Error("status change failed", "err", err)
+		return
+	}
+	log.Info("status changed")
+	log.Debug("redmine response", "response", res)
+}
+
 func main() {
 	configFile := flag.String("config", "./config.toml", "Path to config file")
+	preview := flag.String("preview", "", "Render payload file (or message:<id> from DB) through templates and exit")
+	migrate := flag.String("migrate", "", "Run schema migrations (up, down or status) and exit")
+	healthcheck := flag.Bool("healthcheck", false, "Check /readyz of the running bot, exit 1 if it is not ready")
 	flag.Parse()
 
 	config := parseConfig(*configFile)
+	if err := initLogger(config); err != nil {
+		log.Fatal(err)
+	}
+	tgbotapi.SetLogger(logger)
 
-	issueUpdates := make(chan RedmineRequest, config.QueueSize)
-	defer close(issueUpdates)
+	if *migrate != "" {
+		if err := runMigrate(config, *migrate, os.Stdout); err != nil {
+			logger.Fatal("migrate failed", "err", err)
+		}
+		return
+	}
+
+	if *healthcheck {
+		if err := runHealthcheck(config); err != nil {
+			logger.Fatal("not ready", "err", err)
+		}
+		return
+	}
+
+	if *preview != "" {
+		if err := runPreview(config, *preview); err != nil {
+			logger.Fatal("preview failed", "err", err)
+		}
+		return
+	}
+
+	i18n, err := LoadTranslator(config.LocalesDir, config.DefaultLanguage)
+	if err != nil {
+		logger.Fatal("locales failed", "err", err)
+	}
+	templates, err := loadTemplates(config, i18n.Languages())
+	if err != nil {
+		logger.Fatal("templates failed", "err", err)
+	}
+
+	issueUpdates := make(chan QueuedEvent, config.QueueSize)
 
 	db := NewDBInstance(config.DbFile)
 	var globalLock sync.Mutex
 	globalLock.Lock()
 	defer globalLock.Unlock()
 	ProcessMigrations(db)
+	store := NewDBStore(db)
 
 	bot, tgUpdates := initTgBot(config)
 	redmine := NewRedmineClient(config)
-	handler := NewIssuesHandler(config, bot, redmine, issueUpdates)
-	server, bindURL := initHTTPServer(config, issueUpdates, handler)
-	authHandler := NewAuthHandler(config, db, bot)
+	sender := NewSender(config, bot, store, i18n)
+	notifier := NewNotifier(config, sender, store)
+	handler := NewIssuesHandler(config, redmine, store, notifier, templates, i18n, issueUpdates)
+	rules := NewRuleResolver(config.Rules, redmine, store, i18n)
+	handler.AddResolver(rules)
+	publishQueueDepth(handler)
+	server, bindURL := initHTTPServer(config, handler, tgUpdates)
+	NewHealthChecker(config, store, redmine, bot).Register(server)
+	adminAPI := NewAdminAPI(config, store, redmine, handler)
+	adminAPI.Register(server)
+	NewDashboard(config, adminAPI, i18n).Register(server)
+	authHandler := NewAuthHandler(config, store, bot, i18n, rules)
+	groupHandler := NewGroupHandler(store, bot, redmine, i18n)
+	var issuePoller *IssuePoller
+	if config.Polling.Interval > 0 {
+		issuePoller = NewIssuePoller(config, redmine, store, handler)
+		go issuePoller.Run()
+	}
 
 	go func() {
-		server.Logger.Fatal(server.Start(bindURL))
-	}()
-	go func() {
-		for update := range tgUpdates {
-			if update.CallbackQuery != nil{
-				postStatusID,err := strconv.Atoi((string([]rune(update.CallbackQuery.Data)[0])))
-				issueID,err := strconv.Atoi((string([]rune(update.CallbackQuery.Data)[1:])))
-				if err != nil {
-					log.Fatal(err)
-				}
-				res := redmine.UpdateStatusIssue(issueID, postStatusID)
-				fmt.Println(res)
-			}
-			if update.Message == nil {
-				continue
-			}
-			authHandler.Authenticate(update.Message)
+		if err := server.Start(bindURL); err != http.ErrServerClosed {
+			logger.Fatal("http server failed", "err", err)
 		}
 	}()
+	logger.Info("bot started", "listen", bindURL, "telegram", config.Telegram.Mode, "log_level", config.LogLevel)
+	go tgUpdates.Run()
+	dispatcher := newDispatcher(config, redmine, sender, authHandler, groupHandler)
+	go dispatcher.Run(tgUpdates.Updates())
 	go handler.Run()
+	go notifier.Run()
+	go templates.Watch()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	defer close(quit)
 	signal.Notify(quit, os.Interrupt)
 
@@ -222,10 +253,18 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	bot.StopReceivingUpdates()
-	handler.Stop()
+	tgUpdates.Stop()
+	if issuePoller != nil {
+		issuePoller.Stop()
+	}
 	if err := server.Shutdown(ctx); err != nil {
-		server.Logger.Fatal(err)
+		logger.Fatal("http server shutdown failed", "err", err)
+	}
+	// Stored events that are not finished in time are processed after restart
+	if err := handler.Shutdown(ctx); err != nil {
+		logger.Warn("events left pending", "err", err)
 	}
+	notifier.Stop()
+	templates.Stop()
 	os.Exit(0)
 }
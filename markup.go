@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Telegram understands only &lt; &gt; &amp; &quot; and numeric entities
+var telegramEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&quot;",
+)
+
+// escapeHTML makes text safe for ParseMode "html"
+func escapeHTML(text string) string {
+	return telegramEscaper.Replace(text)
+}
+
+// truncateText cuts text to limit characters, should be applied before escaping
+func truncateText(limit int, text string) string {
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	runes := []rune(text)
+	return strings.TrimSpace(string(runes[:limit])) + "…"
+}
+
+// Formats of dates in Redmine API and webhook payloads
+var redmineDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05.000Z07:00",
+	"2006-01-02 15:04:05 MST",
+	"2006/01/02 15:04:05 -0700",
+	"2006-01-02",
+}
+
+func formatDate(layout string, value string) string {
+	for _, redmineLayout := range redmineDateLayouts {
+		if t, err := time.Parse(redmineLayout, value); err == nil {
+			return t.Local().Format(layout)
+		}
+	}
+	return value
+}
+
+func htmlLink(url string, text string) string {
+	return fmt.Sprintf(`<a href="%s">%s</a>`, escapeHTML(url), escapeHTML(text))
+}
+
+// Code blocks and spans are cut out before inline formatting and put back at the end
+var (
+	textileCodeRe  = regexp.MustCompile(`(?s)<pre>(?:\s*<code[^>]*>)?(.*?)(?:</code>\s*)?</pre>|(?:^|\s)@([^@\n]+)@`)
+	markdownCodeRe = regexp.MustCompile("(?s)```[\\w-]*\\n?(.*?)```|`([^`\\n]+)`")
+	placeholderRe  = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+type inlineRule struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// Inline markup, applied to escaped text. Delimiters must not be surrounded
+// by letters so that phone numbers and snake_case survive.
+const (
+	markupOpen  = `(^|[\s(>\[])`
+	markupClose = `($|[\s.,;:!?)<\]])`
+)
+
+func inlineMarkupRule(delimiter string, tag string) inlineRule {
+	d := regexp.QuoteMeta(delimiter)
+	return inlineRule{
+		re:      regexp.MustCompile(markupOpen + d + `(\S|\S.*?\S)` + d + markupClose),
+		replace: "${1}<" + tag + ">${2}</" + tag + ">${3}",
+	}
+}
+
+var textileRules = []inlineRule{
+	{regexp.MustCompile(`(?m)^h[1-6]\.\s+(.+)$`), "<b>$1</b>"},
+	{regexp.MustCompile(`(?m)^bq\.\s+(.+)$`), "<blockquote>$1</blockquote>"},
+	{regexp.MustCompile(`(?m)^[*#]+\s+`), "• "},
+	{regexp.MustCompile(`&quot;([^&\n]+?)&quot;:(https?://[^\s<]+[^\s<.,;:!?)])`), `<a href="$2">$1</a>`},
+	inlineMarkupRule("*", "b"),
+	inlineMarkupRule("_", "i"),
+	inlineMarkupRule("+", "u"),
+	inlineMarkupRule("-", "s"),
+}
+
+var markdownRules = []inlineRule{
+	{regexp.MustCompile(`(?m)^#{1,6}\s+(.+)$`), "<b>$1</b>"},
+	{regexp.MustCompile(`(?m)^&gt;\s?(.+)$`), "<blockquote>$1</blockquote>"},
+	{regexp.MustCompile(`(?m)^\s*[*+-]\s+`), "• "},
+	{regexp.MustCompile(`\[([^\]\n]+)\]\((https?://[^\s)]+)\)`), `<a href="$2">$1</a>`},
+	inlineMarkupRule("**", "b"),
+	inlineMarkupRule("__", "b"),
+	inlineMarkupRule("*", "i"),
+	inlineMarkupRule("_", "i"),
+	inlineMarkupRule("~~", "s"),
+}
+
+// markupToHTML converts Redmine text formatting into Telegram HTML.
+// format is Redmine "Text formatting" setting: "textile" (default) or "markdown".
+func markupToHTML(format string, text string) string {
+	codeRe, rules := textileCodeRe, textileRules
+	if format == "markdown" || format == "common_mark" {
+		codeRe, rules = markdownCodeRe, markdownRules
+	}
+
+	// NUL delimits code placeholders, text from Redmine must not fake them
+	text = strings.ReplaceAll(text, "\x00", "")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	original := text
+
+	var code []string
+	text = codeRe.ReplaceAllStringFunc(text, func(match string) string {
+		groups := codeRe.FindStringSubmatch(match)
+		var html string
+		if groups[1] != "" || strings.HasSuffix(match, "```") || strings.HasSuffix(match, "</pre>") {
+			html = "<pre>" + escapeHTML(strings.Trim(groups[1], "\n")) + "</pre>"
+		} else {
+			prefix := match[:strings.IndexAny(match, "@`")]
+			html = prefix + "<code>" + escapeHTML(groups[2]) + "</code>"
+		}
+		code = append(code, html)
+		return "\x00" + strconv.Itoa(len(code)-1) + "\x00"
+	})
+
+	text = escapeHTML(text)
+	for _, rule := range rules {
+		// Adjacent matches share boundary characters, a second pass picks them up
+		for pass := 0; pass < 2; pass++ {
+			text = rule.re.ReplaceAllString(text, rule.replace)
+		}
+	}
+
+	text = placeholderRe.ReplaceAllStringFunc(text, func(match string) string {
+		idx, err := strconv.Atoi(strings.Trim(match, "\x00"))
+		if err != nil || idx >= len(code) {
+			return match
+		}
+		return code[idx]
+	})
+
+	// Overlapping markup like "*a _b* c_" gives crossed tags that Telegram rejects
+	if !isBalancedHTML(text) {
+		return escapeHTML(original)
+	}
+	return text
+}
+
+func isBalancedHTML(text string) bool {
+	var stack []string
+	for _, token := range tokenizeHTML(text, true) {
+		if token.tag == "" {
+			continue
+		}
+		if !token.closing {
+			stack = append(stack, token.tag)
+			continue
+		}
+		if len(stack) == 0 || stack[len(stack)-1] != token.tag {
+			return false
+		}
+		stack = stack[:len(stack)-1]
+	}
+	return len(stack) == 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestEscapeHTML(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`a < b & "c" > d`, "a &lt; b &amp; &quot;c&quot; &gt; d"},
+		{"it's plain", "it's plain"},
+		{"&amp;", "&amp;amp;"},
+	}
+	for _, tt := range tests {
+		if got := escapeHTML(tt.text); got != tt.want {
+			t.Errorf("escapeHTML(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestMarkupToHTML(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		text   string
+		want   string
+	}{
+		{"textile bold and italic", "textile", "*важно* и _срочно_", "<b>важно</b> и <i>срочно</i>"},
+		{"textile heading", "textile", "h2. Адрес", "<b>Адрес</b>"},
+		{"textile link", "textile", `"сайт":https://example.com/a`, `<a href="https://example.com/a">сайт</a>`},
+		{"textile inline code is not formatted", "textile", "run @a *b* c@", "run <code>a *b* c</code>"},
+		{"textile pre", "textile", "<pre>x < y</pre>", "<pre>x &lt; y</pre>"},
+		{"phone and snake_case survive", "textile", "+7-900-000-00-00 snake_case_name", "+7-900-000-00-00 snake_case_name"},
+		{"html is escaped", "textile", "<script>&", "&lt;script&gt;&amp;"},
+		{"markdown bold and link", "markdown", "**a** [b](https://e.com)", `<b>a</b> <a href="https://e.com">b</a>`},
+		{"markdown code block", "markdown", "```go\nif a < b {}\n```", "<pre>if a &lt; b {}</pre>"},
+		{"crossed tags fall back to plain text", "textile", "*a _b* c_", "*a _b* c_"},
+		{"windows line ends", "textile", "a\r\nb", "a\nb"},
+		{"forged placeholder", "textile", "foo \x005\x00 bar", "foo 5 bar"},
+		{"forged placeholder next to code", "textile", "\x000\x00 @x@", "0 <code>x</code>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := markupToHTML(tt.format, tt.text); got != tt.want {
+				t.Errorf("markupToHTML(%q, %q) = %q, want %q", tt.format, tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		limit int
+		text  string
+		want  string
+	}{
+		{10, "короткий", "короткий"},
+		{5, "длинный текст", "длинн…"},
+		{6, "слово слово", "слово…"},
+	}
+	for _, tt := range tests {
+		if got := truncateText(tt.limit, tt.text); got != tt.want {
+			t.Errorf("truncateText(%d, %q) = %q, want %q", tt.limit, tt.text, got, tt.want)
+		}
+	}
+}
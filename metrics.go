@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics served on /metrics
+var (
+	webhooksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_webhooks_total",
+		Help: "Redmine webhooks by action and result (stored, duplicate, error, bad_request).",
+	}, []string{"action", "result"})
+
+	notificationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_notifications_total",
+		Help: "Notifications by channel (staff, client, group) and outcome (sent, deferred, unavailable, failed).",
+	}, []string{"channel", "outcome"})
+
+	redmineRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bot_redmine_request_duration_seconds",
+		Help:    "Redmine API request latency by endpoint and HTTP status, retries included.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "status"})
+
+	redmineCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_redmine_cache_requests_total",
+		Help: "Lookups in the Redmine response cache by result (hit, miss).",
+	}, []string{"result"})
+
+	callbacksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_callbacks_total",
+		Help: "Telegram button presses by type.",
+	}, []string{"type"})
+
+	journalLookupFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_journal_lookup_failures_total",
+		Help: "Journal values shown as \"#<id>\" because the lookup failed, by prop_key.",
+	}, []string{"prop_key"})
+
+	dispatcherPanics = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bot_dispatcher_panics_total",
+		Help: "Panics recovered in Telegram update handlers.",
+	})
+)
+
+var redmineIDRe = regexp.MustCompile(`/\d+`)
+
+// redmineEndpoint - path of the API url with ids replaced, e.g. "issues/:id.json"
+func redmineEndpoint(apiHost string, rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "unknown"
+	}
+	base, err := url.Parse(apiHost)
+	path := parsed.Path
+	if err == nil && len(path) >= len(base.Path) {
+		path = path[len(base.Path):]
+	}
+	return redmineIDRe.ReplaceAllString("/"+path, "/:id")[1:]
+}
+
+func httpStatusLabel(status int) string {
+	if status == 0 {
+		return "error"
+	}
+	return strconv.Itoa(status)
+}
+
+// notificationChannel - label of the recipient for bot_notifications_total
+func notificationChannel(recipient Recipient) string {
+	if recipient.User.Chat < 0 {
+		return "group"
+	}
+	return recipient.Template
+}
+
+// publishQueueDepth exposes IssuesHandler.QueueDepth on /metrics
+func publishQueueDepth(handler *IssuesHandler) {
+	depth := func() float64 { return float64(handler.QueueDepth()) }
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "bot_issue_queue_depth",
+		Help: "Webhook events waiting for a worker.",
+	}, depth)
+}
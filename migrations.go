@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Migration - numbered schema change. Up and Down run in one transaction
+// together with the update of schema_migrations. Migrations spell out the
+// schema of their version in SQL and never use the models, so a migration
+// does the same thing however the models change later.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration - applied migration
+type SchemaMigration struct {
+	Version   int       `gorm:"column:version;primary_key;auto_increment:false"`
+	Name      string    `gorm:"column:name"`
+	AppliedAt time.Time `gorm:"column:applied_at"`
+}
+
+// migrations in the order of versions, append new ones to the end
+var migrations = []Migration{
+	{Version: 1, Name: "users_constraints", Up: fixUserConstraints, Down: revertUserConstraints},
+	{Version: 2, Name: "indexes", Up: addIndexes, Down: dropIndexes},
+	{Version: 3, Name: "outbound_language", Up: addOutboundLanguage, Down: keepOutboundLanguage},
+	{Version: 4, Name: "group_chats_failed", Up: addGroupChatFailed, Down: keepGroupChatFailed},
+}
+
+// modelColumns - columns of gorm.Model, every table starts with them
+var modelColumns = []string{
+	"id integer primary key autoincrement",
+	"created_at datetime",
+	"updated_at datetime",
+	"deleted_at datetime",
+}
+
+// tableColumns - names of the columns of table, empty if there is no table
+func tableColumns(tx *gorm.DB, table string) (map[string]bool, error) {
+	rows, err := tx.Raw(fmt.Sprintf("PRAGMA table_info(%q)", table)).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, kind       string
+			value            interface{}
+		)
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &value, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// columnExists reports whether table has column, false if there is no table
+func columnExists(tx *gorm.DB, table string, column string) (bool, error) {
+	columns, err := tableColumns(tx, table)
+	return columns[column], err
+}
+
+// renameColumn renames the column if the table has it
+func renameColumn(tx *gorm.DB, table string, from string, to string) error {
+	exists, err := columnExists(tx, table, from)
+	if err != nil || !exists {
+		return err
+	}
+	return tx.Exec(fmt.Sprintf("ALTER TABLE %q RENAME COLUMN %q TO %q", table, from, to)).Error
+}
+
+// ensureTable creates table with modelColumns and columns ("name type"), or
+// adds the columns it lacks to a table created by an older version of the
+// bot, which used gorm AutoMigrate instead of migrations
+func ensureTable(tx *gorm.DB, table string, columns ...string) error {
+	existing, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		var definitions []string
+		for _, column := range append(append([]string{}, modelColumns...), columns...) {
+			parts := strings.SplitN(column, " ", 2)
+			definitions = append(definitions, fmt.Sprintf("%q %s", parts[0], parts[1]))
+		}
+		return execAll(tx,
+			fmt.Sprintf("CREATE TABLE %q (%s)", table, strings.Join(definitions, ",")),
+			fmt.Sprintf("CREATE INDEX idx_%s_deleted_at ON %q(deleted_at)", table, table),
+		)
+	}
+	for _, column := range columns {
+		parts := strings.SplitN(column, " ", 2)
+		if existing[parts[0]] {
+			continue
+		}
+		if err := execAll(tx, fmt.Sprintf("ALTER TABLE %q ADD COLUMN %q %s", table, parts[0], parts[1])); err != nil {
+			return err
+		}
+	}
+	return execAll(tx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_deleted_at ON %q(deleted_at)", table, table))
+}
+
+// execAll runs the statements until the first error
+func execAll(tx *gorm.DB, statements ...string) error {
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return fmt.Errorf("%s: %v", statement, err)
+		}
+	}
+	return nil
+}
+
+// duplicateUser - settings of a users row that mergeDuplicateUsers carries over
+type duplicateUser struct {
+	ID         uint
+	Key        int64
+	IsAdmin    bool
+	RedmineID  int
+	QuietStart string
+	QuietEnd   string
+	Timezone   string
+	Language   string
+}
+
+// mergeDuplicateUsers leaves one active row per value of column (chat or
+// tg_user_id): the newest one. The admin flag of any row is kept, the Redmine
+// id, quiet hours and language of older rows fill what the newest one lacks.
+// Older rows are soft-deleted.
+func mergeDuplicateUsers(tx *gorm.DB, column string) error {
+	rows, err := tx.Raw(fmt.Sprintf(`SELECT id, %[1]s, COALESCE(is_admin, 0), COALESCE(redmine_id, 0),
+		COALESCE(quiet_start, ''), COALESCE(quiet_end, ''), COALESCE(timezone, ''), COALESCE(language, '')
+		FROM users WHERE deleted_at IS NULL AND COALESCE(%[1]s, 0) <> 0 ORDER BY id DESC`, column)).Rows()
+	if err != nil {
+		return err
+	}
+	groups := make(map[int64][]duplicateUser)
+	var keys []int64
+	for rows.Next() {
+		var user duplicateUser
+		if err := rows.Scan(&user.ID, &user.Key, &user.IsAdmin, &user.RedmineID, &user.QuietStart, &user.QuietEnd, &user.Timezone, &user.Language); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := groups[user.Key]; !ok {
+			keys = append(keys, user.Key)
+		}
+		groups[user.Key] = append(groups[user.Key], user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		merged := group[0]
+		var deleted []uint
+		for _, older := range group[1:] {
+			merged.IsAdmin = merged.IsAdmin || older.IsAdmin
+			if merged.RedmineID == 0 {
+				merged.RedmineID = older.RedmineID
+			} else if older.RedmineID != 0 && older.RedmineID != merged.RedmineID {
+				logger.Warn("duplicate user has another redmine id", column, key, "kept", merged.ID, "redmine_id", merged.RedmineID, "dropped", older.ID, "dropped_redmine_id", older.RedmineID)
+			}
+			if merged.QuietStart == "" && merged.QuietEnd == "" {
+				merged.QuietStart, merged.QuietEnd, merged.Timezone = older.QuietStart, older.QuietEnd, older.Timezone
+			}
+			if merged.Language == "" {
+				merged.Language = older.Language
+			}
+			deleted = append(deleted, older.ID)
+		}
+		err := tx.Exec("UPDATE users SET is_admin = ?, redmine_id = ?, quiet_start = ?, quiet_end = ?, timezone = ?, language = ? WHERE id = ?",
+			merged.IsAdmin, merged.RedmineID, merged.QuietStart, merged.QuietEnd, merged.Timezone, merged.Language, merged.ID).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Exec("UPDATE users SET deleted_at = ? WHERE id IN (?)", time.Now(), deleted).Error; err != nil {
+			return err
+		}
+		logger.Warn("duplicate users merged", column, key, "kept", merged.ID, "deleted", fmt.Sprint(deleted), "is_admin", merged.IsAdmin)
+	}
+	return nil
+}
+
+// fixUserConstraints gives the columns of users the names their tags meant
+// (the tags used to be malformed, so gorm named them tg_user and
+// "uniqie,column:issue") and makes chat and Telegram user unique, merging
+// duplicates into the newest row
+func fixUserConstraints(tx *gorm.DB) error {
+	if err := renameColumn(tx, "users", "tg_user", "tg_user_id"); err != nil {
+		return err
+	}
+	if err := renameColumn(tx, "users", "uniqie,column:issue", "issue"); err != nil {
+		return err
+	}
+	err := ensureTable(tx, "users",
+		"phone varchar(255)",
+		"chat bigint",
+		"tg_user_id integer",
+		"is_admin bool",
+		"redmine_id integer",
+		"issue bool",
+		"current_issue_id integer",
+		"quiet_start varchar(255)",
+		"quiet_end varchar(255)",
+		"timezone varchar(255)",
+		"chat_failed bool",
+		"chat_error varchar(255)",
+		"language varchar(255)",
+	)
+	if err != nil {
+		return err
+	}
+	for _, column := range []string{"chat", "tg_user_id"} {
+		if err := mergeDuplicateUsers(tx, column); err != nil {
+			return err
+		}
+	}
+	return execAll(tx,
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_users_chat ON users(chat) WHERE deleted_at IS NULL",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_users_tg_user_id ON users(tg_user_id) WHERE deleted_at IS NULL AND tg_user_id <> 0",
+	)
+}
+
+// revertUserConstraints restores the schema older versions of the bot expect,
+// merged duplicates stay deleted
+func revertUserConstraints(tx *gorm.DB) error {
+	if err := execAll(tx,
+		"DROP INDEX IF EXISTS idx_users_chat",
+		"DROP INDEX IF EXISTS idx_users_tg_user_id",
+	); err != nil {
+		return err
+	}
+	if err := renameColumn(tx, "users", "tg_user_id", "tg_user"); err != nil {
+		return err
+	}
+	return renameColumn(tx, "users", "issue", "uniqie,column:issue")
+}
+
+// addIndexes creates the other tables and indexes for the lookups by phone,
+// Redmine user, message recipient and webhook deduplication
+func addIndexes(tx *gorm.DB) error {
+	tables := []struct {
+		name    string
+		columns []string
+	}{
+		{"messages", []string{"tg_user_id integer", "issue_id integer", "status varchar(255)", "subject varchar(255)", "phone varchar(255)",
+			"is_admin bool", "status_send bool", "apply_status_send bool", "json_message varchar(255)"}},
+		{"deliveries", []string{"issue_id integer", "journal_id integer", "tg_user_id integer", "chat bigint", "thread_id integer",
+			"template varchar(255)", "message_id integer", "outbound_id integer", "tg_message_id integer", "status varchar(255)",
+			"error varchar(255)", "queued_at datetime", "sent_at datetime", "failed_at datetime", "edited_at datetime"}},
+		{"outbound_messages", []string{"chat bigint", "thread_id integer", "issue_id integer", "text varchar(255)",
+			"parse_mode varchar(255)", "reply_markup varchar(255)", "deliver_at datetime", "delivered bool"}},
+		{"long_messages", []string{"chat bigint", "thread_id integer", "text varchar(255)", "parse_mode varchar(255)"}},
+		{"webhook_events", []string{"issue_id integer", "action varchar(255)", "journal_id integer", "source varchar(255)",
+			"correlation_id varchar(255)", "payload varchar(255)", "processed bool", "error varchar(255)"}},
+		{"group_chats", []string{"chat bigint", "title varchar(255)", "type varchar(255)", "language varchar(255)"}},
+		{"chat_bindings", []string{"chat bigint", "thread_id integer", "project_id integer", "tracker_id integer", "assignee_id integer"}},
+		{"checkpoints", []string{"name varchar(255)", "value datetime"}},
+	}
+	for _, table := range tables {
+		if err := ensureTable(tx, table.name, table.columns...); err != nil {
+			return err
+		}
+	}
+	return execAll(tx,
+		"CREATE INDEX IF NOT EXISTS idx_messages_issue_id ON messages(issue_id)",
+		"CREATE INDEX IF NOT EXISTS idx_deliveries_issue_id ON deliveries(issue_id)",
+		"CREATE INDEX IF NOT EXISTS idx_deliveries_tg_user_id ON deliveries(tg_user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_deliveries_chat ON deliveries(chat)",
+		"CREATE INDEX IF NOT EXISTS idx_deliveries_outbound_id ON deliveries(outbound_id)",
+		"CREATE INDEX IF NOT EXISTS idx_outbound_messages_chat ON outbound_messages(chat)",
+		"CREATE INDEX IF NOT EXISTS idx_outbound_messages_issue_id ON outbound_messages(issue_id)",
+		"CREATE INDEX IF NOT EXISTS idx_outbound_messages_deliver_at ON outbound_messages(deliver_at)",
+		"CREATE INDEX IF NOT EXISTS idx_webhook_events_issue_id ON webhook_events(issue_id)",
+		"CREATE INDEX IF NOT EXISTS idx_webhook_events_processed ON webhook_events(processed)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS uix_group_chats_chat ON group_chats(chat)",
+		"CREATE INDEX IF NOT EXISTS idx_chat_bindings_chat ON chat_bindings(chat)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS uix_checkpoints_name ON checkpoints(name)",
+		"CREATE INDEX IF NOT EXISTS idx_users_phone ON users(phone)",
+		"CREATE INDEX IF NOT EXISTS idx_users_redmine_id ON users(redmine_id)",
+		"CREATE INDEX IF NOT EXISTS idx_messages_tg_user_id ON messages(tg_user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_webhook_events_change ON webhook_events(issue_id, action, journal_id)",
+	)
+}
+
+// dropIndexes drops the indexes added for lookups, tables are kept with their data
+func dropIndexes(tx *gorm.DB) error {
+	return execAll(tx,
+		"DROP INDEX IF EXISTS idx_users_phone",
+		"DROP INDEX IF EXISTS idx_users_redmine_id",
+		"DROP INDEX IF EXISTS idx_messages_tg_user_id",
+		"DROP INDEX IF EXISTS idx_webhook_events_change",
+	)
+}
+
+// addOutboundLanguage stores the language of a deferred message for the
+// buttons Sender adds when it is sent
+func addOutboundLanguage(tx *gorm.DB) error {
+	return ensureTable(tx, "outbound_messages", "language varchar(255)")
+}
+
+// keepOutboundLanguage - SQLite of go-sqlite3 can't drop columns, older
+// versions of the bot ignore the column and addOutboundLanguage keeps it
+func keepOutboundLanguage(tx *gorm.DB) error {
+	return nil
+}
+
+// addGroupChatFailed marks groups the bot was removed from like users' chats
+func addGroupChatFailed(tx *gorm.DB) error {
+	return ensureTable(tx, "group_chats", "chat_failed bool", "chat_error varchar(255)")
+}
+
+// keepGroupChatFailed - the columns can't be dropped, see keepOutboundLanguage
+func keepGroupChatFailed(tx *gorm.DB) error {
+	return nil
+}
+
+// appliedMigrations - versions from schema_migrations, the table is created if needed
+func appliedMigrations(db *gorm.DB) (map[int]SchemaMigration, error) {
+	err := execAll(db, "CREATE TABLE IF NOT EXISTS schema_migrations (version integer primary key, name varchar(255), applied_at datetime)")
+	if err != nil {
+		return nil, err
+	}
+	var rows []SchemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int]SchemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// runMigration applies or reverts one migration in a transaction
+func runMigration(db *gorm.DB, migration Migration, up bool) (err error) {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("migration %d %s: %v", migration.Version, migration.Name, err)
+		}
+	}()
+	if up {
+		if err = migration.Up(tx); err != nil {
+			return err
+		}
+		err = tx.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+	} else {
+		if err = migration.Down(tx); err != nil {
+			return err
+		}
+		err = tx.Where("version = ?", migration.Version).Delete(SchemaMigration{}).Error
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// MigrateUp applies pending migrations, returns how many were applied
+func MigrateUp(db *gorm.DB) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := runMigration(db, migration, true); err != nil {
+			return count, err
+		}
+		logger.Info("migration applied", "version", migration.Version, "name", migration.Name)
+		count++
+	}
+	return count, nil
+}
+
+// MigrateDown reverts the latest applied migration, nil if nothing is applied
+func MigrateDown(db *gorm.DB) (*Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	for idx := len(migrations) - 1; idx >= 0; idx-- {
+		migration := migrations[idx]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if err := runMigration(db, migration, false); err != nil {
+			return nil, err
+		}
+		logger.Info("migration reverted", "version", migration.Version, "name", migration.Name)
+		return &migration, nil
+	}
+	return nil, nil
+}
+
+// ProcessMigrations brings the schema up to date on start
+func ProcessMigrations(db *gorm.DB) {
+	if _, err := MigrateUp(db); err != nil {
+		logger.Fatal("migrations failed", "err", err)
+	}
+}
+
+// runMigrate implements -migrate up|down|status against Config.DbFile
+func runMigrate(config Config, command string, out io.Writer) error {
+	db := NewDBInstance(config.DbFile)
+	defer db.Close()
+
+	switch command {
+	case "up":
+		count, err := MigrateUp(db)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "applied %d migration(s)\n", count)
+	case "down":
+		migration, err := MigrateDown(db)
+		if err != nil {
+			return err
+		}
+		if migration == nil {
+			fmt.Fprintln(out, "nothing to revert")
+		} else {
+			fmt.Fprintf(out, "reverted %d %s\n", migration.Version, migration.Name)
+		}
+	case "status":
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			state := "pending"
+			if row, ok := applied[migration.Version]; ok {
+				state = "applied " + row.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(out, "%3d  %-20s %s\n", migration.Version, migration.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown -migrate command %q, expected up, down or status", command)
+	}
+	return nil
+}
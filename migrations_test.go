@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := NewDBInstance(filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	db := newTestDB(t)
+
+	count, err := MigrateUp(db)
+	if err != nil || count != len(migrations) {
+		t.Fatalf("MigrateUp = %d, %v, want %d", count, err, len(migrations))
+	}
+	if count, err := MigrateUp(db); err != nil || count != 0 {
+		t.Fatalf("second MigrateUp = %d, %v, want 0", count, err)
+	}
+
+	for idx := len(migrations) - 1; idx >= 0; idx-- {
+		migration, err := MigrateDown(db)
+		if err != nil {
+			t.Fatalf("MigrateDown: %v", err)
+		}
+		if migration == nil || migration.Version != migrations[idx].Version {
+			t.Fatalf("MigrateDown reverted %v, want version %d", migration, migrations[idx].Version)
+		}
+	}
+	if migration, err := MigrateDown(db); err != nil || migration != nil {
+		t.Fatalf("MigrateDown with nothing applied = %v, %v", migration, err)
+	}
+
+	if count, err := MigrateUp(db); err != nil || count != len(migrations) {
+		t.Fatalf("MigrateUp after down = %d, %v, want %d", count, err, len(migrations))
+	}
+}
+
+func TestMigrateLegacyUsers(t *testing.T) {
+	db := newTestDB(t)
+	err := execAll(db,
+		"CREATE TABLE users (id integer primary key autoincrement, created_at datetime, updated_at datetime, deleted_at datetime, "+
+			"phone varchar(255), chat bigint, tg_user integer, is_admin bool, \"uniqie,column:issue\" bool)",
+		"INSERT INTO users (phone, chat, tg_user, is_admin) VALUES ('79990000001', 10, 100, 1)",
+		"INSERT INTO users (phone, chat, tg_user, is_admin) VALUES ('79990000002', 10, 100, 0)",
+		"INSERT INTO users (phone, chat, tg_user, is_admin) VALUES ('79990000003', 20, 200, 0)",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MigrateUp(db); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	columns, err := tableColumns(db, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range []string{"tg_user_id", "issue", "language", "chat_failed"} {
+		if !columns[column] {
+			t.Errorf("column %s missing after up", column)
+		}
+	}
+	if columns["tg_user"] || columns["uniqie,column:issue"] {
+		t.Errorf("malformed columns kept after up: %v", columns)
+	}
+
+	var users []User
+	if err := db.Order("id").Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("got %d users after merge, want 2", len(users))
+	}
+	if users[0].Phone != "79990000002" || !users[0].IsAdmin {
+		t.Errorf("merged user = %+v, want the newest phone with is_admin", users[0])
+	}
+	if err := db.Create(&User{Chat: 20, TGUser: 300}).Error; err == nil {
+		t.Error("duplicate chat was inserted after up")
+	}
+
+	for range migrations {
+		if _, err := MigrateDown(db); err != nil {
+			t.Fatalf("MigrateDown: %v", err)
+		}
+	}
+	columns, err = tableColumns(db, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !columns["tg_user"] || !columns["uniqie,column:issue"] || columns["tg_user_id"] {
+		t.Errorf("old column names not restored after down: %v", columns)
+	}
+}
+
+func TestRunMigrate(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+		wantErr bool
+	}{
+		{command: "status", want: "pending"},
+		{command: "up", want: "applied 4 migration(s)"},
+		{command: "status", want: "applied 20"},
+		{command: "down", want: "reverted 4 group_chats_failed"},
+		{command: "sideways", wantErr: true},
+	}
+
+	config := Config{DbFile: filepath.Join(t.TempDir(), "test.db")}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := runMigrate(config, tt.command, &out)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: err = %v, wantErr %v", tt.command, err, tt.wantErr)
+		}
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("%s: output %q, want it to contain %q", tt.command, out.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Separator between collapsed updates of one issue in a deferred message
+const outboundSeparator = "\n\n-------------------------------\n\n"
+
+// quietWindow - daily interval [start, end) in minutes since midnight
+type quietWindow struct {
+	start    int
+	end      int
+	location *time.Location
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// newQuietWindow returns nil window if quiet hours are not configured or disabled (start == end)
+func newQuietWindow(start string, end string, timezone string) (*quietWindow, error) {
+	if start == "" || end == "" {
+		return nil, nil
+	}
+	startMinute, err := parseClock(start)
+	if err != nil {
+		return nil, err
+	}
+	endMinute, err := parseClock(end)
+	if err != nil {
+		return nil, err
+	}
+	if startMinute == endMinute {
+		return nil, nil
+	}
+	location := time.Local
+	if timezone != "" {
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &quietWindow{
+		start:    startMinute,
+		end:      endMinute,
+		location: location,
+	}, nil
+}
+
+// until returns the moment the window ends if now is inside it
+func (w *quietWindow) until(now time.Time) (time.Time, bool) {
+	local := now.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+
+	var inside bool
+	if w.start < w.end {
+		inside = minute >= w.start && minute < w.end
+	} else {
+		inside = minute >= w.start || minute < w.end
+	}
+	if !inside {
+		return time.Time{}, false
+	}
+
+	end := time.Date(local.Year(), local.Month(), local.Day(), w.end/60, w.end%60, 0, 0, w.location)
+	if !end.After(local) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end, true
+}
+
+// Notifier - delivers notifications, holding non-urgent ones until quiet hours end
+type Notifier struct {
+	config    Config
+	sender    *Sender
+	store     Store
+	closeChan chan interface{}
+	closeOnce sync.Once
+}
+
+// NewNotifier ...
+func NewNotifier(config Config, sender *Sender, store Store) *Notifier {
+	return &Notifier{
+		config:    config,
+		sender:    sender,
+		store:     store,
+		closeChan: make(chan interface{}),
+	}
+}
+
+// IsUrgent - urgent notifications ignore quiet hours
+func (n *Notifier) IsUrgent(issue Issue) bool {
+	for _, id := range n.config.QuietHours.UrgentPriorities {
+		if issue.Priority.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) quietWindow(user *User) (*quietWindow, error) {
+	quiet := n.config.QuietHours
+	if user.QuietStart == "" && user.QuietEnd == "" {
+		return newQuietWindow(quiet.Start, quiet.End, quiet.Timezone)
+	}
+	timezone := user.Timezone
+	if timezone == "" {
+		timezone = quiet.Timezone
+	}
+	return newQuietWindow(user.QuietStart, user.QuietEnd, timezone)
+}
+
+// Notify sends message right away or stores it until the user's quiet hours end.
+// The outcome is saved in delivery, its ThreadID is the forum topic for group
+// chats, 0 otherwise. lang is the language the message is rendered in.
+func (n *Notifier) Notify(ctx context.Context, user *User, delivery *Delivery, message tgbotapi.MessageConfig, lang string, urgent bool) (deferred bool, err error) {
+	if user.ChatFailed {
+		n.finish(ctx, delivery, DeliveryChatUnavailable, 0, ErrChatUnavailable)
+		return false, ErrChatUnavailable
+	}
+	if !urgent {
+		window, err := n.quietWindow(user)
+		if err != nil {
+			loggerFrom(ctx).Warn("quiet hours ignored", "chat", user.Chat, "err", err)
+		} else if window != nil {
+			if deliverAt, ok := window.until(time.Now()); ok {
+				loggerFrom(ctx).Debug("notification deferred", "chat", user.Chat, "deliver_at", deliverAt)
+				pending, err := n.hold(delivery.ThreadID, delivery.IssueID, message, lang, deliverAt)
+				if err != nil {
+					n.finish(ctx, delivery, DeliveryFailed, 0, err)
+					return true, err
+				}
+				delivery.OutboundID = pending.ID
+				n.finish(ctx, delivery, DeliveryDeferred, 0, nil)
+				return true, nil
+			}
+		}
+	}
+	report := n.sender.Deliver(ctx, withThread(message, delivery.ThreadID), lang)
+	n.finish(ctx, delivery, report.Status, report.Message.MessageID, report.Err)
+	return false, report.Err
+}
+
+// finish saves the status of delivery, deferred ones are finished by flush
+func (n *Notifier) finish(ctx context.Context, delivery *Delivery, status string, tgMessageID int, err error) {
+	now := time.Now()
+	delivery.Status = status
+	delivery.TGMessageID = tgMessageID
+	if err != nil {
+		delivery.Error = err.Error()
+		delivery.FailedAt = &now
+	} else if status == DeliverySent {
+		delivery.SentAt = &now
+	}
+	if err := n.store.SaveDelivery(delivery); err != nil {
+		loggerFrom(ctx).Error("delivery update failed", "delivery", delivery.ID, "err", err)
+	}
+}
+
+// hold collapses updates of the same issue into one pending message
+func (n *Notifier) hold(threadID int, issueID int, message tgbotapi.MessageConfig, lang string, deliverAt time.Time) (*OutboundMessage, error) {
+	pending, err := n.store.GetPendingOutbound(message.ChatID, threadID, issueID, message.ParseMode)
+	if err == ErrNotFound {
+		pending = &OutboundMessage{
+			Chat:      message.ChatID,
+			ThreadID:  threadID,
+			IssueID:   issueID,
+			ParseMode: message.ParseMode,
+			Language:  lang,
+			DeliverAt: deliverAt,
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		pending.Text += outboundSeparator
+	}
+	pending.Text += message.Text
+
+	pending.ReplyMarkup = ""
+	if message.ReplyMarkup != nil {
+		markup, err := json.Marshal(message.ReplyMarkup)
+		if err != nil {
+			return nil, err
+		}
+		if string(markup) != "null" {
+			pending.ReplyMarkup = string(markup)
+		}
+	}
+	return pending, n.store.SaveOutbound(pending)
+}
+
+// outboundMaxAge - a deferred message that still fails this long after it was
+// due is dropped
+const outboundMaxAge = 24 * time.Hour
+
+// abandonOutbound - a failed deferred message is not retried: Telegram rejected
+// it as malformed or it keeps failing for too long
+func abandonOutbound(pending *OutboundMessage, err error, now time.Time) bool {
+	if tgErr, ok := err.(tgbotapi.Error); ok && isClientError(tgErr) {
+		return true
+	}
+	return now.Sub(pending.DeliverAt) > outboundMaxAge
+}
+
+func (n *Notifier) flush() {
+	messages, err := n.store.GetDueOutbound(time.Now())
+	if err != nil {
+		logger.Error("deferred messages lookup failed", "err", err)
+		return
+	}
+	for _, pending := range messages {
+		message := tgbotapi.NewMessage(pending.Chat, pending.Text)
+		message.ParseMode = pending.ParseMode
+		if pending.ReplyMarkup != "" {
+			var kb tgbotapi.InlineKeyboardMarkup
+			if err := json.Unmarshal([]byte(pending.ReplyMarkup), &kb); err == nil {
+				message.ReplyMarkup = kb
+			}
+		}
+		ctx := withLogFields(context.Background(), "outbound", pending.ID, "issue", pending.IssueID)
+		report := n.sender.Deliver(ctx, withThread(message, pending.ThreadID), pending.Language)
+		if report.Status == DeliveryFailed {
+			if !abandonOutbound(pending, report.Err, time.Now()) {
+				// Keep the message pending, next tick will retry it
+				continue
+			}
+			loggerFrom(ctx).Warn("deferred message dropped", "deliver_at", pending.DeliverAt, "err", report.Err)
+		}
+		if err := n.store.MarkOutboundDelivered(pending); err != nil {
+			loggerFrom(ctx).Error("deferred message update failed", "err", err)
+		}
+		reason := ""
+		if report.Err != nil {
+			reason = report.Err.Error()
+		}
+		if err := n.store.FinishOutboundDeliveries(pending.ID, report.Status, report.Message.MessageID, reason, time.Now()); err != nil {
+			loggerFrom(ctx).Error("delivery update failed", "err", err)
+		}
+	}
+}
+
+// Run ...
+func (n *Notifier) Run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.flush()
+		case <-n.closeChan:
+			return
+		}
+	}
+}
+
+// Stop ...
+func (n *Notifier) Stop() {
+	n.closeOnce.Do(func() { close(n.closeChan) })
+}
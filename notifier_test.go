@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestAbandonOutbound(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		due     time.Time
+		err     error
+		abandon bool
+	}{
+		{"unparsable html", now, tgbotapi.Error{Message: "Bad Request: can't parse entities"}, true},
+		{"server error", now, tgbotapi.Error{Message: "Internal Server Error"}, false},
+		{"network error", now.Add(-time.Hour), errors.New("connection reset"), false},
+		{"failing for too long", now.Add(-outboundMaxAge - time.Minute), errors.New("connection reset"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pending := &OutboundMessage{DeliverAt: tt.due}
+			if got := abandonOutbound(pending, tt.err, now); got != tt.abandon {
+				t.Errorf("abandonOutbound = %v, want %v", got, tt.abandon)
+			}
+		})
+	}
+}
+
+func TestNotifierStopAfterRun(t *testing.T) {
+	n := NewNotifier(Config{}, nil, nil)
+	done := make(chan struct{})
+	go func() {
+		n.Run()
+		close(done)
+	}()
+	n.Stop()
+	<-done
+	// Run has returned, a second Stop must not block
+	stopped := make(chan struct{})
+	go func() {
+		n.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked")
+	}
+}
+
+func TestFlushDropsRejectedMessage(t *testing.T) {
+	store := newTestStore(t)
+	telegram := NewFakeTelegram(map[int64]string{300: "Bad Request: can't parse entities"})
+	defer telegram.Close()
+	bot, err := tgbotapi.NewBotAPIWithClient("test", telegram.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{RateLimit: RateLimitConfig{GlobalPerSecond: 1000, ChatPerSecond: 1000, MaxRetries: 3}}
+	notifier := NewNotifier(config, NewSender(config, bot, store, nil), store)
+
+	pending := &OutboundMessage{Chat: 300, IssueID: 101, Text: "<b>broken", ParseMode: "html", DeliverAt: time.Now().Add(-time.Minute)}
+	if err := store.SaveOutbound(pending); err != nil {
+		t.Fatal(err)
+	}
+	delivery := &Delivery{IssueID: 101, TGUser: 300, Chat: 300, OutboundID: pending.ID, Status: DeliveryDeferred}
+	if err := store.CreateDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	notifier.flush()
+
+	if due, err := store.GetDueOutbound(time.Now()); err != nil || len(due) != 0 {
+		t.Fatalf("still pending: %v, %v", due, err)
+	}
+	delivery, err = store.GetDelivery(delivery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != DeliveryFailed || delivery.Error == "" {
+		t.Errorf("delivery %s %q, want failed with the error", delivery.Status, delivery.Error)
+	}
+	if sent := len(telegram.Sent()); sent != 0 {
+		t.Errorf("%d messages sent", sent)
+	}
+}
+
+func TestQuietWindow(t *testing.T) {
+	utc := func(day, hour, minute int) time.Time { return time.Date(2026, 3, day, hour, minute, 0, 0, time.UTC) }
+	tests := []struct {
+		name     string
+		start    string
+		end      string
+		timezone string
+		now      time.Time
+		inside   bool
+		until    time.Time
+	}{
+		// Moscow is UTC+3
+		{"night window before midnight", "22:00", "07:00", "Europe/Moscow", utc(1, 20, 0), true, utc(2, 4, 0)},
+		{"night window after midnight", "22:00", "07:00", "Europe/Moscow", utc(1, 3, 59), true, utc(1, 4, 0)},
+		{"start is inside", "22:00", "07:00", "Europe/Moscow", utc(1, 19, 0), true, utc(2, 4, 0)},
+		{"end is outside", "22:00", "07:00", "Europe/Moscow", utc(1, 4, 0), false, time.Time{}},
+		{"day", "22:00", "07:00", "Europe/Moscow", utc(1, 12, 0), false, time.Time{}},
+		{"day window", "13:00", "14:00", "UTC", utc(1, 13, 30), true, utc(1, 14, 0)},
+		{"after day window", "13:00", "14:00", "UTC", utc(1, 14, 0), false, time.Time{}},
+		{"same time in another zone", "13:00", "14:00", "Asia/Yekaterinburg", utc(1, 13, 30), false, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, err := newQuietWindow(tt.start, tt.end, tt.timezone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			until, inside := window.until(tt.now)
+			if inside != tt.inside || !until.Equal(tt.until) {
+				t.Errorf("until(%v) = %v, %v, want %v, %v", tt.now, until, inside, tt.until, tt.inside)
+			}
+		})
+	}
+}
+
+func TestNewQuietWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    string
+		end      string
+		timezone string
+		window   bool
+		ok       bool
+	}{
+		{"not configured", "", "", "", false, true},
+		{"disabled", "10:00", "10:00", "", false, true},
+		{"configured", "22:00", "07:00", "Europe/Moscow", true, true},
+		{"bad time", "25:00", "07:00", "", false, false},
+		{"bad timezone", "22:00", "07:00", "Mars/Olympus", false, false},
+	}
+	for _, tt := range tests {
+		window, err := newQuietWindow(tt.start, tt.end, tt.timezone)
+		if (err == nil) != tt.ok || (window != nil) != tt.window {
+			t.Errorf("%s: window %v, err %v", tt.name, window, err)
+		}
+	}
+}
+
+func TestNotifyQuietHours(t *testing.T) {
+	now := time.Now().UTC()
+	around := QuietHoursConfig{
+		Start:    now.Add(-time.Hour).Format("15:04"),
+		End:      now.Add(time.Hour).Format("15:04"),
+		Timezone: "UTC",
+	}
+	tests := []struct {
+		name     string
+		quiet    QuietHoursConfig
+		user     User
+		urgent   bool
+		deferred bool
+	}{
+		{"inside quiet hours", around, User{Chat: 300}, false, true},
+		{"urgent", around, User{Chat: 300}, true, false},
+		{"no quiet hours", QuietHoursConfig{}, User{Chat: 300}, false, false},
+		{"user's own hours win", around, User{Chat: 300, QuietStart: "00:00", QuietEnd: "00:00"}, false, false},
+		{"user's hours with the default timezone", QuietHoursConfig{Timezone: "UTC"}, User{Chat: 300, QuietStart: around.Start, QuietEnd: around.End}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			bot := &stubMessenger{}
+			config := Config{QuietHours: tt.quiet}
+			notifier := NewNotifier(config, newTestSender(t, store, bot, config), store)
+			delivery := &Delivery{IssueID: 101, Chat: 300, Status: DeliveryQueued}
+			deferred, err := notifier.Notify(context.Background(), &tt.user, delivery, tgbotapi.NewMessage(300, "text"), "ru", tt.urgent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deferred != tt.deferred {
+				t.Errorf("deferred %v, want %v", deferred, tt.deferred)
+			}
+			wantStatus, wantSent := DeliverySent, 1
+			if tt.deferred {
+				wantStatus, wantSent = DeliveryDeferred, 0
+			}
+			if delivery.Status != wantStatus || len(bot.sent) != wantSent {
+				t.Errorf("delivery %s with %d messages sent, want %s with %d", delivery.Status, len(bot.sent), wantStatus, wantSent)
+			}
+		})
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// A webhook goes through one pipeline: it is stored and acknowledged (Enqueue),
+// then enriched once, recipients are resolved, notifications rendered per
+// template and language and handed to the notifier (processEvent).
+
+// IssueEvent - webhook payload enriched once and shared by all recipients
+type IssueEvent struct {
+	ID           uint
+	Request      RedmineRequest
+	ClientPhone  string
+	ClientNotify bool
+	Details      []resolvedDetail
+}
+
+// Recipient - user and the template of the notification they get
+type Recipient struct {
+	User     *User
+	ThreadID int    // forum topic of a group chat
+	Template string // staffTemplate or clientTemplate
+}
+
+// RecipientResolver - one source of recipients of an event
+type RecipientResolver interface {
+	Resolve(ctx context.Context, event *IssueEvent) ([]Recipient, error)
+}
+
+// staffResolver - author, assignee and watchers, project admins for new issues
+type staffResolver struct {
+	redmine IssueTracker
+	store   Store
+}
+
+func (r *staffResolver) Resolve(ctx context.Context, event *IssueEvent) (recipients []Recipient, err error) {
+	users, err := r.store.FindUsersByPhone(event.Request.GetUserPhones())
+	if err != nil {
+		return nil, err
+	}
+	if event.Request.Payload.Action == "opened" {
+		admins, err := r.admins(ctx, event.Request.Payload.Issue.Project.ID)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, admins...)
+	}
+	for _, user := range users {
+		recipients = append(recipients, Recipient{User: user, Template: staffTemplate})
+	}
+	return recipients, nil
+}
+
+// admins returns bot admins who are members of the project
+func (r *staffResolver) admins(ctx context.Context, projectID int) (admins []*User, err error) {
+	_admins, err := r.store.GetAdmins()
+	if err != nil {
+		return nil, err
+	}
+
+	_members, err := r.redmine.GetMembershipsByProject(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[int]RedmineUser)
+	for _, member := range _members.Users {
+		members[member.User.ID] = member.User
+	}
+
+	for _, admin := range _admins {
+		if _, ok := members[int(admin.RedmineID)]; ok {
+			admins = append(admins, admin)
+		}
+	}
+	return admins, nil
+}
+
+// clientResolver - the client who left the phone number and asked for notifications,
+// told about a new issue and about confirmation, rejection and closing
+type clientResolver struct {
+	store Store
+}
+
+func (r *clientResolver) Resolve(ctx context.Context, event *IssueEvent) (recipients []Recipient, err error) {
+	payload := event.Request.Payload
+	if !event.ClientNotify || event.ClientPhone == "" {
+		return nil, nil
+	}
+	status := payload.Issue.Status.ID
+	if payload.Action != "opened" && !(payload.Action == "updated" && (status == 5 || status == 6 || status == 9)) {
+		return nil, nil
+	}
+	users, err := r.store.FindUsersByPhone([]string{event.ClientPhone})
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		recipients = append(recipients, Recipient{User: user, Template: clientTemplate})
+	}
+	return recipients, nil
+}
+
+// QueuedEvent - stored event waiting for a worker
+type QueuedEvent struct {
+	ID      uint
+	IssueID int
+}
+
+// Enqueue stores the webhook payload and queues it for processing.
+// A full queue is not an error, the event is picked up from the database later.
+// The correlation id of ctx is saved with the event.
+func (h *IssuesHandler) Enqueue(ctx context.Context, request *RedmineRequest) error {
+	stored, err := h.enqueue(ctx, request, "webhook")
+	result := "stored"
+	if err != nil {
+		result = "error"
+	} else if !stored {
+		result = "duplicate"
+	}
+	webhooksTotal.WithLabelValues(request.Payload.Action, result).Inc()
+	return err
+}
+
+// enqueue stores the event unless the same change already came from
+// the webhook or the poller
+func (h *IssuesHandler) enqueue(ctx context.Context, request *RedmineRequest, source string) (stored bool, err error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return false, err
+	}
+	issueID, action, journalID := request.Payload.Issue.ID, request.Payload.Action, request.Payload.Journal.ID
+	if correlationID(ctx) == "" {
+		ctx = withCorrelationID(ctx, newCorrelationID())
+	}
+	log := loggerFrom(ctx).With("issue", issueID, "action", action, "journal", journalID, "source", source)
+
+	h.enqueueMu.Lock()
+	defer h.enqueueMu.Unlock()
+	// An update without journal id can't be matched, it is always processed
+	if action == "opened" || journalID != 0 {
+		if _, err := h.store.FindWebhookEvent(issueID, action, journalID); err == nil {
+			log.Debug("duplicate event skipped")
+			return false, nil
+		} else if err != ErrNotFound {
+			return false, err
+		}
+	}
+	event, err := h.store.CreateWebhookEvent(issueID, action, journalID, source, correlationID(ctx), string(payload))
+	if err != nil {
+		return false, err
+	}
+	log = log.With("event", event.ID)
+	select {
+	case h.updates <- QueuedEvent{ID: event.ID, IssueID: event.IssueID}:
+		log.Info("event queued")
+	default:
+		log.Warn("queue is full, event will be processed later")
+	}
+	return true, nil
+}
+
+// submit hands the event to the worker of its issue, so events of one issue
+// are processed in order. An event that is already with a worker is skipped.
+// Returns false when the handler is stopping.
+func (h *IssuesHandler) submit(event QueuedEvent) bool {
+	if !h.claim(event.ID) {
+		return true
+	}
+	idx := event.IssueID % len(h.workers)
+	if idx < 0 {
+		idx = -idx
+	}
+	select {
+	case h.workers[idx] <- event:
+		return true
+	case <-h.closeChan:
+		h.release(event.ID)
+		return false
+	}
+}
+
+// claim marks the event in flight, false if it already is
+func (h *IssuesHandler) claim(id uint) bool {
+	h.inflightMu.Lock()
+	defer h.inflightMu.Unlock()
+	if h.inflight[id] {
+		return false
+	}
+	h.inflight[id] = true
+	return true
+}
+
+// release - the worker is done with the event
+func (h *IssuesHandler) release(id uint) {
+	h.inflightMu.Lock()
+	defer h.inflightMu.Unlock()
+	delete(h.inflight, id)
+}
+
+// QueueDepth - events waiting in the queue and in the workers' queues
+func (h *IssuesHandler) QueueDepth() int {
+	depth := len(h.updates)
+	for _, queue := range h.workers {
+		depth += len(queue)
+	}
+	return depth
+}
+
+func (h *IssuesHandler) processPending() {
+	events, err := h.store.GetPendingWebhookEvents()
+	if err != nil {
+		logger.Error("pending events lookup failed", "err", err)
+		return
+	}
+	for _, event := range events {
+		// Events queued or being processed are skipped by submit, an event
+		// still waiting in updates is skipped by its worker as processed
+		if !h.submit(QueuedEvent{ID: event.ID, IssueID: event.IssueID}) {
+			return
+		}
+	}
+}
+
+// processEvent runs the pipeline for a stored event, each event is processed once.
+// Records logged on the way carry the correlation id of the webhook.
+func (h *IssuesHandler) processEvent(ctx context.Context, id uint) {
+	stored, err := h.store.GetWebhookEvent(id)
+	if err != nil {
+		logger.Error("event lookup failed", "event", id, "err", err)
+		return
+	}
+	if stored.Processed {
+		return
+	}
+	if stored.CorrelationID != "" {
+		ctx = withCorrelationID(ctx, stored.CorrelationID)
+	}
+	ctx = withLogFields(ctx, "event", stored.ID, "issue", stored.IssueID)
+	log := loggerFrom(ctx)
+
+	var reason string
+	request := new(RedmineRequest)
+	if err := json.Unmarshal([]byte(stored.Payload), request); err != nil {
+		reason = err.Error()
+	} else {
+		event := h.enrich(ctx, request)
+		event.ID = stored.ID
+		if err := h.notify(ctx, event); err != nil {
+			reason = err.Error()
+		}
+	}
+	if reason != "" {
+		log.Error("event failed", "reason", reason)
+	} else {
+		log.Info("event processed")
+	}
+	if err := h.store.MarkWebhookEventProcessed(stored, reason); err != nil {
+		log.Error("event update failed", "err", err)
+	}
+}
+
+// enrich fetches current custom fields of the issue and resolves journal names.
+// Failed lookups only degrade the notification.
+func (h *IssuesHandler) enrich(ctx context.Context, request *RedmineRequest) *IssueEvent {
+	// Webhook payloads don't always carry custom fields
+	fields, err := h.redmine.GetAPIForCustomFields(ctx, request.Payload.Issue.ID)
+	if err != nil {
+		loggerFrom(ctx).Warn("custom fields lookup failed", "err", err)
+		journalLookupFailures.WithLabelValues("custom_fields").Inc()
+	} else {
+		request.Payload.Issue.CustomFieldValues = fields.Issue.CustomFieldValues
+	}
+
+	event := &IssueEvent{Request: *request}
+	event.ClientPhone, event.ClientNotify = clientPhoneFromCustomFields(request.Payload.Issue)
+	event.Details = h.resolveJournal(ctx, request.Payload.Issue, request.Payload.Journal.Details)
+	loggerFrom(ctx).Debug("event enriched", "details", len(event.Details), "client_notify", event.ClientNotify)
+	return event
+}
+
+func (h *IssuesHandler) recipients(ctx context.Context, event *IssueEvent) (recipients []Recipient) {
+	seen := make(map[string]bool)
+	for _, resolver := range h.resolvers {
+		found, err := resolver.Resolve(ctx, event)
+		if err != nil {
+			loggerFrom(ctx).Error("recipients lookup failed", "resolver", fmt.Sprintf("%T", resolver), "err", err)
+			continue
+		}
+		for _, recipient := range found {
+			key := fmt.Sprintf("%d:%d:%s", recipient.User.Chat, recipient.ThreadID, recipient.Template)
+			if !seen[key] {
+				seen[key] = true
+				recipients = append(recipients, recipient)
+			}
+		}
+	}
+	return recipients
+}
+
+// render returns notification text for the template in lang, cached per event
+func (h *IssuesHandler) render(event *IssueEvent, template string, lang string, cache map[string]string) (string, error) {
+	key := template + "." + lang
+	if text, ok := cache[key]; ok {
+		return text, nil
+	}
+	var data interface{}
+	if template == clientTemplate {
+		data = h.buildClientTemplateData(event)
+	} else {
+		templateData := h.buildTemplateData(event, lang)
+		data = &templateData
+	}
+	text, err := h.templates.RenderLocalized(template, lang, data)
+	if err != nil {
+		return "", err
+	}
+	cache[key] = text
+	return text, nil
+}
+
+func (h *IssuesHandler) notify(ctx context.Context, event *IssueEvent) error {
+	urgent := h.notifier.IsUrgent(event.Request.Payload.Issue)
+	rendered := make(map[string]string)
+	payload := eventPayload(event)
+
+	var renderErr error
+	for _, recipient := range h.recipients(ctx, event) {
+		if result := h.notifyRecipient(ctx, event, recipient, urgent, rendered, payload); result.RenderErr != nil {
+			renderErr = result.RenderErr
+		}
+	}
+	return renderErr
+}
+
+// notifyResult - outcome of notifyRecipient. A render error fails the event,
+// a send error is only logged by notify.
+type notifyResult struct {
+	RenderErr error
+	SendErr   error
+}
+
+// notifyRecipient renders the notification for one recipient, records its
+// payload and delivery and hands it to the notifier
+func (h *IssuesHandler) notifyRecipient(ctx context.Context, event *IssueEvent, recipient Recipient, urgent bool, rendered map[string]string, payload string) notifyResult {
+	issue := event.Request.Payload.Issue
+	user := recipient.User
+	lang := h.i18n.Language(user.Language)
+	log := loggerFrom(ctx).With("chat", user.Chat, "template", recipient.Template, "lang", lang)
+	text, err := h.render(event, recipient.Template, lang, rendered)
+	if err != nil {
+		log.Error("render failed", "err", err)
+		return notifyResult{RenderErr: err}
+	}
+	if strings.TrimSpace(text) == "" {
+		log.Debug("empty notification skipped")
+		return notifyResult{}
+	}
+	log.Debug("notification rendered", "length", len(text))
+
+	message := tgbotapi.NewMessage(user.Chat, text)
+	isAdmin := recipient.Template == staffTemplate
+	phone := event.ClientPhone
+	if isAdmin {
+		message.ParseMode = "html"
+		message.ReplyMarkup = h.buildKeyboard(event.Request, lang)
+		phone = user.Phone
+	}
+
+	delivery := &Delivery{
+		IssueID:   issue.ID,
+		JournalID: event.Request.Payload.Journal.ID,
+		TGUser:    user.TGUser,
+		Chat:      user.Chat,
+		ThreadID:  recipient.ThreadID,
+		Template:  recipient.Template,
+		Status:    DeliveryQueued,
+		QueuedAt:  time.Now(),
+	}
+	if record, err := h.store.GetOrCreateMessage(user.TGUser, issue.ID, issue.Status.Name, issue.Subject, phone, isAdmin, payload); err != nil {
+		log.Error("message record failed", "err", err)
+	} else {
+		delivery.MessageID = record.ID
+	}
+	// Notify saves the delivery anyway, a failed insert only loses the queued state
+	if err := h.store.CreateDelivery(delivery); err != nil {
+		log.Error("delivery record failed", "err", err)
+	}
+	log = log.With("delivery", delivery.ID)
+
+	deferred, sendErr := h.notifier.Notify(ctx, user, delivery, message, lang, urgent)
+	outcome := "sent"
+	switch {
+	case sendErr == ErrChatUnavailable || isPermanentChatError(sendErr):
+		outcome = "unavailable"
+	case sendErr != nil:
+		outcome = "failed"
+	case deferred:
+		outcome = "deferred"
+	}
+	notificationsTotal.WithLabelValues(notificationChannel(recipient), outcome).Inc()
+	if sendErr != nil {
+		log.Error("notification failed", "outcome", outcome, "err", sendErr)
+	}
+	return notifyResult{SendErr: sendErr}
+}
+
+// Resend renders the notification of a delivery again from its payload and
+// sends it to the same chat right away, quiet hours are ignored
+func (h *IssuesHandler) Resend(ctx context.Context, delivery *Delivery) error {
+	if delivery.MessageID == 0 {
+		return ErrNotFound
+	}
+	message, err := h.store.GetMessage(delivery.MessageID)
+	if err != nil {
+		return err
+	}
+	var user *User
+	if delivery.TGUser != 0 {
+		user, err = h.store.GetUserByTGUser(delivery.TGUser)
+	} else {
+		user, err = chatUser(h.store, delivery.Chat)
+	}
+	if err != nil {
+		return err
+	}
+	request := new(RedmineRequest)
+	if err := json.Unmarshal([]byte(message.JSONMessage), request); err != nil {
+		return err
+	}
+	ctx = withLogFields(ctx, "resend", delivery.ID, "issue", request.Payload.Issue.ID)
+	event := h.enrich(ctx, request)
+	recipient := Recipient{User: user, ThreadID: delivery.ThreadID, Template: delivery.Template}
+	result := h.notifyRecipient(ctx, event, recipient, true, make(map[string]string), eventPayload(event))
+	if result.RenderErr != nil {
+		return result.RenderErr
+	}
+	return result.SendErr
+}
+
+// Replay makes a stored event pending and queues it, e.g. an event from the
+// dead-letter queue after the cause is fixed
+func (h *IssuesHandler) Replay(ctx context.Context, id uint) error {
+	event, err := h.store.GetWebhookEvent(id)
+	if err != nil {
+		return err
+	}
+	if err := h.store.ResetWebhookEvent(event); err != nil {
+		return err
+	}
+	select {
+	case h.updates <- QueuedEvent{ID: event.ID, IssueID: event.IssueID}:
+	default:
+		// processPending picks it up from the database
+	}
+	loggerFrom(ctx).Info("event replayed", "event", event.ID, "issue", event.IssueID, "previous_error", event.Error)
+	return nil
+}
+
+// eventPayload - enriched payload saved with sent messages
+func eventPayload(event *IssueEvent) string {
+	payload, err := json.Marshal(event.Request)
+	if err != nil {
+		logger.Error("payload encoding failed", "event", event.ID, "err", err)
+	}
+	return string(payload)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcessPendingSkipsInflight(t *testing.T) {
+	store := newTestStore(t)
+	config := Config{IssueWorkers: 1, QueueSize: 10}
+	handler := NewIssuesHandler(config, nil, store, nil, nil, nil, make(chan QueuedEvent, 10))
+	for _, issueID := range []int{101, 102} {
+		if _, err := store.CreateWebhookEvent(issueID, "opened", 0, "webhook", "", "{}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The worker is busy, both ticks find the same pending events
+	handler.processPending()
+	handler.processPending()
+	if depth := handler.QueueDepth(); depth != 2 {
+		t.Fatalf("%d events queued, want 2", depth)
+	}
+
+	// Once the worker is done with an event it may be submitted again
+	event := <-handler.workers[0]
+	handler.release(event.ID)
+	handler.processPending()
+	if depth := handler.QueueDepth(); depth != 2 {
+		t.Errorf("%d events queued after release, want 2", depth)
+	}
+}
+
+// recordingStore remembers the order in which events of each issue were processed
+type recordingStore struct {
+	*DBStore
+	mu        sync.Mutex
+	processed map[int][]uint
+}
+
+func (s *recordingStore) MarkWebhookEventProcessed(event *WebhookEvent, reason string) error {
+	s.mu.Lock()
+	s.processed[event.IssueID] = append(s.processed[event.IssueID], event.ID)
+	s.mu.Unlock()
+	return s.DBStore.MarkWebhookEventProcessed(event, reason)
+}
+
+func TestRunKeepsIssueOrderAndDrains(t *testing.T) {
+	tests := []struct {
+		workers int
+		issues  int
+		events  int
+	}{
+		{workers: 1, issues: 3, events: 12},
+		{workers: 3, issues: 5, events: 30},
+		{workers: 8, issues: 4, events: 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d workers", tt.workers), func(t *testing.T) {
+			store := &recordingStore{DBStore: newTestStore(t), processed: make(map[int][]uint)}
+			config := Config{IssueWorkers: tt.workers, QueueSize: tt.events}
+			handler := NewIssuesHandler(config, nil, store, nil, nil, nil, make(chan QueuedEvent, 1))
+
+			// Events are with the workers before Run starts, Shutdown must
+			// wait until all of them are processed. The payloads don't parse,
+			// so each event fails fast without Redmine.
+			for idx := 0; idx < tt.events; idx++ {
+				event, err := store.CreateWebhookEvent(100+idx%tt.issues, "updated", idx, "webhook", "", "not json")
+				if err != nil {
+					t.Fatal(err)
+				}
+				handler.submit(QueuedEvent{ID: event.ID, IssueID: event.IssueID})
+			}
+			go handler.Run()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := handler.Shutdown(ctx); err != nil {
+				t.Fatalf("Shutdown: %v", err)
+			}
+
+			if count, err := store.CountPendingWebhookEvents(); err != nil || count != 0 {
+				t.Errorf("%d events pending after Shutdown (%v), want 0", count, err)
+			}
+			total := 0
+			for issueID, ids := range store.processed {
+				total += len(ids)
+				for idx := 1; idx < len(ids); idx++ {
+					if ids[idx] <= ids[idx-1] {
+						t.Errorf("issue %d: events processed out of order: %v", issueID, ids)
+						break
+					}
+				}
+			}
+			if total != tt.events {
+				t.Errorf("%d events processed, want %d", total, tt.events)
+			}
+		})
+	}
+}
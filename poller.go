@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const pollerCheckpoint = "redmine_poller"
+
+// IssuePoller - fallback for a broken webhook plugin. It asks Redmine for
+// issues updated since the checkpoint and turns new issues and journals into
+// the same events the webhook delivers. Changes already received through
+// the webhook are skipped by IssuesHandler.enqueue.
+type IssuePoller struct {
+	interval  time.Duration
+	redmine   IssueTracker
+	store     Store
+	handler   *IssuesHandler
+	closeChan chan interface{}
+	// ctx of polls, Stop cancels it to abort a running poll
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewIssuePoller ...
+func NewIssuePoller(config Config, redmine IssueTracker, store Store, handler *IssuesHandler) *IssuePoller {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &IssuePoller{
+		interval:  time.Duration(config.Polling.Interval) * time.Second,
+		redmine:   redmine,
+		store:     store,
+		handler:   handler,
+		closeChan: make(chan interface{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Run ...
+func (p *IssuePoller) Run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(p.ctx, p.interval)
+			if err := p.poll(ctx); err != nil {
+				logger.Error("poll failed", "err", err)
+			}
+			cancel()
+		case <-p.closeChan:
+			return
+		}
+	}
+}
+
+// Stop aborts a running poll and doesn't wait for Run to return
+func (p *IssuePoller) Stop() {
+	p.cancel()
+	close(p.closeChan)
+}
+
+func parseRedmineTime(value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
+
+// poll enqueues changes made at or after the checkpoint. The first run only
+// saves the checkpoint, history before the bot started is not replayed.
+func (p *IssuePoller) poll(ctx context.Context) error {
+	checkpoint, err := p.store.GetCheckpoint(pollerCheckpoint)
+	if err == ErrNotFound {
+		checkpoint = &Checkpoint{Name: pollerCheckpoint, Value: time.Now().UTC()}
+		return p.store.SaveCheckpoint(checkpoint)
+	} else if err != nil {
+		return err
+	}
+
+	issues, err := p.redmine.GetUpdatedIssues(ctx, checkpoint.Value)
+	if err != nil {
+		return err
+	}
+	users, err := p.users(ctx)
+	if err != nil {
+		// Without mails recipients can't be found by phone, try again next time
+		return err
+	}
+
+	latest := checkpoint.Value
+	for _, listed := range issues {
+		issue, journals, err := p.redmine.GetIssueJournals(ctx, listed.ID)
+		if err != nil {
+			// The checkpoint stays before this issue, it is polled again
+			logger.Error("poll of issue failed", "issue", listed.ID, "err", err)
+			break
+		}
+		p.fillUsers(issue, users)
+
+		if !parseRedmineTime(issue.CreatedOn).Before(checkpoint.Value) {
+			if err := p.enqueue(*issue, "opened", Journal{}); err != nil {
+				return err
+			}
+		}
+		for _, apiJournal := range journals {
+			if parseRedmineTime(apiJournal.CreatedOn).Before(checkpoint.Value) {
+				continue
+			}
+			journal := apiJournal.Journal()
+			if author, ok := users[journal.Author.ID]; ok {
+				journal.Author = author
+			}
+			if err := p.enqueue(*issue, "updated", journal); err != nil {
+				return err
+			}
+		}
+		if updated := parseRedmineTime(issue.UpdatedOn); updated.After(latest) {
+			latest = updated
+		}
+	}
+
+	// Changes made within the same second as latest are requested again
+	// next time and dropped as duplicates
+	checkpoint.Value = latest
+	return p.store.SaveCheckpoint(checkpoint)
+}
+
+func (p *IssuePoller) enqueue(issue Issue, action string, journal Journal) error {
+	_, err := p.handler.enqueue(context.Background(), &RedmineRequest{Payload: Payload{
+		Action:  action,
+		Issue:   issue,
+		Journal: journal,
+		URL:     fmt.Sprintf("%sissues/%d", p.handler.config.RedmineHost, issue.ID),
+	}}, "poller")
+	return err
+}
+
+func (p *IssuePoller) users(ctx context.Context) (map[int]RedmineUser, error) {
+	response, err := p.redmine.GetUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[int]RedmineUser)
+	for _, user := range response.Users {
+		users[user.ID] = user
+	}
+	return users, nil
+}
+
+// fillUsers sets mails of the issue users, the REST API only returns their
+// ids and names, while recipients are found by the phone in the mail
+func (p *IssuePoller) fillUsers(issue *Issue, users map[int]RedmineUser) {
+	fill := func(user RedmineUser) RedmineUser {
+		if found, ok := users[user.ID]; ok {
+			return found
+		}
+		return user
+	}
+	issue.Author = fill(issue.Author)
+	issue.Assignee = fill(RedmineUser{ID: issueAssigneeID(*issue)})
+	for idx, watcher := range issue.Watchers {
+		issue.Watchers[idx] = fill(watcher)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// loadPreviewPayload reads RedmineRequest from a JSON file or, for "message:<id>",
+// from a message stored in the database
+func loadPreviewPayload(config Config, source string) (*RedmineRequest, error) {
+	var raw []byte
+	if strings.HasPrefix(source, "message:") {
+		id, err := strconv.Atoi(strings.TrimPrefix(source, "message:"))
+		if err != nil {
+			return nil, err
+		}
+		db := NewDBInstance(config.DbFile)
+		defer db.Close()
+		message := new(Message)
+		if err := db.First(message, id).Error; err != nil {
+			return nil, err
+		}
+		raw = []byte(message.JSONMessage)
+	} else {
+		data, err := ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		raw = data
+	}
+
+	request := new(RedmineRequest)
+	if err := json.Unmarshal(raw, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// runPreview renders payload through staff and client templates to stdout.
+// Redmine is still queried for names, Telegram is never contacted.
+func runPreview(config Config, source string) error {
+	request, err := loadPreviewPayload(config, source)
+	if err != nil {
+		return err
+	}
+	i18n, err := LoadTranslator(config.LocalesDir, config.DefaultLanguage)
+	if err != nil {
+		return err
+	}
+	templates, err := loadTemplates(config, i18n.Languages())
+	if err != nil {
+		return err
+	}
+
+	handler := NewIssuesHandler(config, NewRedmineClient(config), nil, nil, templates, i18n, nil)
+	event := handler.enrich(context.Background(), request)
+	clientData := handler.buildClientTemplateData(event)
+
+	for _, lang := range i18n.Languages() {
+		data := handler.buildTemplateData(event, lang)
+		staff, err := handler.renderTemplate(lang, &data)
+		if err != nil {
+			return err
+		}
+		client, err := templates.RenderLocalized(clientTemplate, lang, clientData)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("===== staff [%s] =====\n%s\n\n", lang, staff)
+		fmt.Printf("===== client [%s] =====\n%s\n\n", lang, client)
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -71,7 +74,8 @@ type Tracker struct {
 
 // Issue ...
 type Issue struct {
-	Assignee          RedmineUser `json:"assignee"`
+	Assignee          RedmineUser `json:"assignee"`    // webhook payload
+	AssignedTo        RedmineUser `json:"assigned_to"` // REST API
 	Author            RedmineUser `json:"author"`
 	ClosedOn          string      `json:"closed_on"`
 	CreatedOn         string      `json:"created_on"`
@@ -118,7 +122,7 @@ type Journal struct {
 	PrivateNotes bool        `json:"private_notes"`
 }
 
-//File attachments...
+// File attachments...
 type Attachments struct {
 	File Issue `json:"issue"`
 }
@@ -131,15 +135,11 @@ type Payload struct {
 	URL     string  `json:"url"`
 }
 
-func (p *Payload) ActionName() string {
-	switch p.Action {
-	case "opened":
-		return "открыта"
-	case "updated":
-		return "обновлена"
-	default:
+func (p *Payload) ActionName(i18n *Translator, lang string) string {
+	if !i18n.Has(lang, "action."+p.Action) {
 		return p.Action
 	}
+	return i18n.T(lang, "action."+p.Action)
 }
 
 // RedmineRequest ...
@@ -171,22 +171,148 @@ func (rq *RedmineRequest) GetUserPhones() (phones []string) {
 	return phones
 }
 
+// IssueTracker - Redmine API used by handlers, implemented by RedmineClient
+type IssueTracker interface {
+	GetIssueStatuses(ctx context.Context) (*IssueStatusesResponse, error)
+	GetIssuePriorities(ctx context.Context) (*IssuePrioritiesResponse, error)
+	GetCustomFields(ctx context.Context) (*CustomFieldsResponse, error)
+	GetTrackers(ctx context.Context) (*TrackersResponse, error)
+	GetUsers(ctx context.Context) (*UsersResponse, error)
+	GetVersion(ctx context.Context, id int) (*NamedObjectResponse, error)
+	GetIssueCategory(ctx context.Context, id int) (*NamedObjectResponse, error)
+	GetProject(ctx context.Context, id int) (*NamedObjectResponse, error)
+	GetIssueSubject(ctx context.Context, id int) (*NamedObjectResponse, error)
+	GetMembershipsByProject(ctx context.Context, id int) (*MembershipsResponse, error)
+	GetGroupUsers(ctx context.Context, id int) ([]RedmineUser, error)
+	GetIssue(ctx context.Context, id int) (*Issue, error)
+	GetUpdatedIssues(ctx context.Context, since time.Time) ([]Issue, error)
+	GetIssueJournals(ctx context.Context, id int) (*Issue, []APIJournal, error)
+	GetAPIForCustomFields(ctx context.Context, id int) (*CustomFieldIssueResponse, error)
+	UpdateStatusIssue(ctx context.Context, issueID int, postStatusID int, notes string) (string, error)
+	FlushCache() int
+}
+
 // RedmineClient ...
 type RedmineClient struct {
 	config *Config
 	cache  *ccache.Cache
+	http   *req.Req
 }
 
 // NewRedmineClient - Function for create RedmineClient instance
 func NewRedmineClient(config Config) *RedmineClient {
 	cache := ccache.New(ccache.Configure())
+
+	httpClient := &http.Client{}
+	if (config.Proxy != ProxyConfig{}) {
+		if proxyClient := getProxyClient(
+			config.Proxy.Scheme,
+			config.Proxy.Host,
+			config.Proxy.Port,
+			config.Proxy.User,
+			config.Proxy.Password,
+		); proxyClient != nil {
+			httpClient = proxyClient
+		}
+	}
+	httpClient.Timeout = config.Redmine.timeout()
+
+	r := req.New()
+	r.SetClient(httpClient)
+
 	return &RedmineClient{
 		config: &config,
 		cache:  cache,
+		http:   r,
+	}
+}
+
+// Typed errors of Redmine API, check them with errors.Is / errors.As
+var (
+	ErrRedmineNotFound  = errors.New("Redmine: not found")
+	ErrRedmineForbidden = errors.New("Redmine: forbidden")
+)
+
+// APIError - unexpected HTTP status from Redmine
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Redmine %s %s: HTTP %d: %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// Is makes errors.Is(err, ErrRedmineNotFound) and errors.Is(err, ErrRedmineForbidden) work
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrRedmineNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRedmineForbidden:
+		return e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusUnauthorized
+	}
+	return false
+}
+
+// ValidationError - HTTP 422 with Redmine's list of validation errors
+type ValidationError struct {
+	APIError
+	Errors []string `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Redmine %s %s: validation failed: %s", e.Method, e.URL, strings.Join(e.Errors, "; "))
+}
+
+// Retries are done only for requests that are safe to repeat. A PUT that
+// timed out may already be applied, repeating it adds its notes again.
+func isIdempotent(method string) bool {
+	return method == "GET"
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// FlushCache drops cached Redmine responses, returns how many there were
+func (rc *RedmineClient) FlushCache() int {
+	count := rc.cache.ItemCount()
+	rc.cache.Clear()
+	return count
+}
+
+// cacheGet - cache lookup counted in bot_redmine_cache_requests_total
+func (rc *RedmineClient) cacheGet(key string) *ccache.Item {
+	item := rc.cache.Get(key)
+	if item != nil {
+		redmineCacheTotal.WithLabelValues("hit").Inc()
+	} else {
+		redmineCacheTotal.WithLabelValues("miss").Inc()
 	}
+	return item
 }
 
-func (rc *RedmineClient) makeRequest(method, url string, header req.Header, params req.Param) (res *req.Resp, err error) {
+// makeRequest performs the request retrying network errors and 5xx of GET with
+// exponential backoff, non-2xx responses are returned as typed errors
+func (rc *RedmineClient) makeRequest(ctx context.Context, method, url string, header req.Header, params req.Param) (res *req.Resp, err error) {
+	started := time.Now()
+	status := 0 // of the last attempt, 0 for network errors
+	endpoint := redmineEndpoint(rc.config.RedmineAPIHost, url)
+	defer func() {
+		elapsed := time.Since(started)
+		redmineRequestDuration.WithLabelValues(endpoint, httpStatusLabel(status)).Observe(elapsed.Seconds())
+		loggerFrom(ctx).Debug("redmine request", "method", method, "endpoint", endpoint, "status", httpStatusLabel(status), "duration", elapsed)
+	}()
+
 	_header := req.Header{
 		"X-Redmine-API-Key": rc.config.RedmineToken,
 	}
@@ -194,25 +320,60 @@ func (rc *RedmineClient) makeRequest(method, url string, header req.Header, para
 		_header[k] = v
 	}
 
-	if rc.config.Debug == "true" {
-		req.Debug = true
+	retries := 0
+	if isIdempotent(method) {
+		retries = rc.config.Redmine.maxRetries()
 	}
+	backoff := rc.config.Redmine.retryDelay()
+
+	for attempt := 0; ; attempt++ {
+		switch method {
+		case "POST":
+			res, err = rc.http.Post(url, _header, req.BodyJSON(params), ctx)
+		case "GET":
+			res, err = rc.http.Get(url, _header, params, ctx)
+		case "PUT":
+			res, err = rc.http.Put(url, _header, req.BodyJSON(params), ctx)
+		default:
+			return nil, errors.New("Method param is required")
+		}
 
-	switch method {
-	case "POST":
-		res, err = req.Post(url, _header, req.BodyJSON(params))
-	case "GET":
-		res, err = req.Get(url, _header, params)
-	case "PUT":
-		res, err = req.Put(url, _header, req.BodyJSON(params))
-	default:
-		return nil, errors.New("Method param is required")
+		status = 0
+		if err == nil {
+			status = res.Response().StatusCode
+		}
+		retry := false
+		if err != nil {
+			retry = ctx.Err() == nil
+		} else if res.Response().StatusCode >= 500 {
+			retry = true
+			err = &APIError{Method: method, URL: url, StatusCode: res.Response().StatusCode, Body: res.String()}
+		}
+		if !retry || attempt >= retries {
+			break
+		}
+		loggerFrom(ctx).Debug("redmine request failed, retrying", "method", method, "endpoint", endpoint, "attempt", attempt+1, "err", err)
+		if sleepErr := sleepContext(ctx, backoff); sleepErr != nil {
+			return nil, err
+		}
+		backoff *= 2
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	return res, nil
+	switch {
+	case status >= 200 && status < 300:
+		return res, nil
+	case status == http.StatusUnprocessableEntity:
+		validation := &ValidationError{APIError: APIError{Method: method, URL: url, StatusCode: status}}
+		if jsonErr := res.ToJSON(validation); jsonErr != nil {
+			validation.Errors = []string{res.String()}
+		}
+		return nil, validation
+	default:
+		return nil, &APIError{Method: method, URL: url, StatusCode: status, Body: res.String()}
+	}
 }
 
 // IssueStatusesResponse ...
@@ -221,16 +382,16 @@ type IssueStatusesResponse struct {
 }
 
 // GetIssueStatuses - Get issue status types
-func (rc *RedmineClient) GetIssueStatuses() (statuses *IssueStatusesResponse, err error) {
+func (rc *RedmineClient) GetIssueStatuses(ctx context.Context) (statuses *IssueStatusesResponse, err error) {
 	apiURL := rc.config.RedmineAPIHost + "issue_statuses.json"
 
-	cached := rc.cache.Get(apiURL)
+	cached := rc.cacheGet(apiURL)
 	if cached != nil {
 		statuses = cached.Value().(*IssueStatusesResponse)
 		return statuses, nil
 	}
 
-	res, err := rc.makeRequest("GET", apiURL, nil, nil)
+	res, err := rc.makeRequest(ctx, "GET", apiURL, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -252,16 +413,16 @@ type IssuePrioritiesResponse struct {
 }
 
 // GetIssuePriorities - Get issue priority types
-func (rc *RedmineClient) GetIssuePriorities() (priorities *IssuePrioritiesResponse, err error) {
+func (rc *RedmineClient) GetIssuePriorities(ctx context.Context) (priorities *IssuePrioritiesResponse, err error) {
 	apiURL := rc.config.RedmineAPIHost + "enumerations/issue_priorities.json"
 
-	cached := rc.cache.Get(apiURL)
+	cached := rc.cacheGet(apiURL)
 	if cached != nil {
 		priorities = cached.Value().(*IssuePrioritiesResponse)
 		return priorities, nil
 	}
 
-	res, err := rc.makeRequest("GET", apiURL, nil, nil)
+	res, err := rc.makeRequest(ctx, "GET", apiURL, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -287,16 +448,16 @@ type CustomFieldsResponse struct {
 }
 
 // GetCustomFields - Get all custom fields names
-func (rc *RedmineClient) GetCustomFields() (fields *CustomFieldsResponse, err error) {
+func (rc *RedmineClient) GetCustomFields(ctx context.Context) (fields *CustomFieldsResponse, err error) {
 	apiURL := rc.config.RedmineAPIHost + "custom_fields.json"
 
-	cached := rc.cache.Get(apiURL)
+	cached := rc.cacheGet(apiURL)
 	if cached != nil {
 		fields = cached.Value().(*CustomFieldsResponse)
 		return fields, nil
 	}
 
-	res, err := rc.makeRequest("GET", apiURL, nil, nil)
+	res, err := rc.makeRequest(ctx, "GET", apiURL, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -312,6 +473,95 @@ func (rc *RedmineClient) GetCustomFields() (fields *CustomFieldsResponse, err er
 	return fields, nil
 }
 
+// TrackersResponse ...
+type TrackersResponse struct {
+	Trackers []Tracker `json:"trackers"`
+}
+
+// GetTrackers - Get all trackers
+func (rc *RedmineClient) GetTrackers(ctx context.Context) (trackers *TrackersResponse, err error) {
+	apiURL := rc.config.RedmineAPIHost + "trackers.json"
+
+	cached := rc.cacheGet(apiURL)
+	if cached != nil {
+		trackers = cached.Value().(*TrackersResponse)
+		return trackers, nil
+	}
+
+	res, err := rc.makeRequest(ctx, "GET", apiURL, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	trackers = new(TrackersResponse)
+	err = res.ToJSON(trackers)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.cache.Set(apiURL, trackers, 60*time.Minute)
+
+	return trackers, nil
+}
+
+// NamedObjectResponse - any Redmine object that has a name, e.g. version or category
+type NamedObjectResponse struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+}
+
+// getNamedObject fetches <kind>/<id>.json, where kind is "versions", "issue_categories",
+// "projects" or "issues", and unwraps the single root object
+func (rc *RedmineClient) getNamedObject(ctx context.Context, kind string, root string, id int) (object *NamedObjectResponse, err error) {
+	apiURL := rc.config.RedmineAPIHost + "%s/%d.json"
+	apiURL = fmt.Sprintf(apiURL, kind, id)
+
+	cached := rc.cacheGet(apiURL)
+	if cached != nil {
+		object = cached.Value().(*NamedObjectResponse)
+		return object, nil
+	}
+
+	res, err := rc.makeRequest(ctx, "GET", apiURL, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	wrapper := make(map[string]*NamedObjectResponse)
+	err = res.ToJSON(&wrapper)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := wrapper[root]
+	if !ok || object == nil {
+		return nil, ErrValueNotFound
+	}
+
+	rc.cache.Set(apiURL, object, 60*time.Minute)
+
+	return object, nil
+}
+
+// GetVersion - Get version (fixed_version_id) by id
+func (rc *RedmineClient) GetVersion(ctx context.Context, id int) (*NamedObjectResponse, error) {
+	return rc.getNamedObject(ctx, "versions", "version", id)
+}
+
+// GetIssueCategory - Get issue category by id
+func (rc *RedmineClient) GetIssueCategory(ctx context.Context, id int) (*NamedObjectResponse, error) {
+	return rc.getNamedObject(ctx, "issue_categories", "issue_category", id)
+}
+
+// GetProject - Get project by id
+func (rc *RedmineClient) GetProject(ctx context.Context, id int) (*NamedObjectResponse, error) {
+	return rc.getNamedObject(ctx, "projects", "project", id)
+}
+
+// GetIssueSubject - Get issue by id, only id and subject are filled
+func (rc *RedmineClient) GetIssueSubject(ctx context.Context, id int) (*NamedObjectResponse, error) {
+	return rc.getNamedObject(ctx, "issues", "issue", id)
+}
+
 type UsersResponse struct {
 	Users      []RedmineUser `json:"users"`
 	TotalCount int           `json:"total_count"`
@@ -319,12 +569,12 @@ type UsersResponse struct {
 	Offset     int           `json:"offset"`
 }
 
-func (rc *RedmineClient) GetUsers() (users *UsersResponse, err error) {
+func (rc *RedmineClient) GetUsers(ctx context.Context) (users *UsersResponse, err error) {
 	var tempUsers *UsersResponse
 
 	apiURL := rc.config.RedmineAPIHost + "users.json"
 
-	cached := rc.cache.Get(apiURL)
+	cached := rc.cacheGet(apiURL)
 	if cached != nil {
 		users = cached.Value().(*UsersResponse)
 		return users, nil
@@ -338,7 +588,7 @@ func (rc *RedmineClient) GetUsers() (users *UsersResponse, err error) {
 
 	for idx := 0; idx < 100; idx++ {
 		url := fmt.Sprintf("%s?limit=%d&offset=%d", apiURL, limit, offset)
-		res, err := rc.makeRequest("GET", url, nil, nil)
+		res, err := rc.makeRequest(ctx, "GET", url, nil, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -363,22 +613,32 @@ func (rc *RedmineClient) GetUsers() (users *UsersResponse, err error) {
 	return users, nil
 }
 
+// Role ...
+type Role struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Membership - user of a project and their roles
+type Membership struct {
+	User  RedmineUser `json:"user"`
+	Roles []Role      `json:"roles"`
+}
+
 type MembershipsResponse struct {
-	Users []struct {
-		User RedmineUser `json:"user"`
-	} `json:"memberships"`
-	TotalCount int `json:"total_count"`
-	Limit      int `json:"limit"`
-	Offset     int `json:"offset"`
+	Users      []Membership `json:"memberships"`
+	TotalCount int          `json:"total_count"`
+	Limit      int          `json:"limit"`
+	Offset     int          `json:"offset"`
 }
 
-func (rc *RedmineClient) GetMembershipsByProject(id int) (memberships *MembershipsResponse, err error) {
+func (rc *RedmineClient) GetMembershipsByProject(ctx context.Context, id int) (memberships *MembershipsResponse, err error) {
 	var tempMembers *MembershipsResponse
 
 	apiURL := rc.config.RedmineAPIHost + "projects/%d/memberships.json"
 	apiURL = fmt.Sprintf(apiURL, id)
 
-	cached := rc.cache.Get(apiURL)
+	cached := rc.cacheGet(apiURL)
 	if cached != nil {
 		memberships = cached.Value().(*MembershipsResponse)
 		return memberships, nil
@@ -392,7 +652,7 @@ func (rc *RedmineClient) GetMembershipsByProject(id int) (memberships *Membershi
 
 	for idx := 0; idx < 100; idx++ {
 		url := fmt.Sprintf("%s?limit=%d&offset=%d", apiURL, limit, offset)
-		res, err := rc.makeRequest("GET", url, nil, nil)
+		res, err := rc.makeRequest(ctx, "GET", url, nil, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -417,99 +677,228 @@ func (rc *RedmineClient) GetMembershipsByProject(id int) (memberships *Membershi
 	return memberships, nil
 }
 
-// Функция для заполнения массива настраиваемых полей (Его выполнение Вы можете увидеть в main.go,
-// функция makeClientRequest)
+// GroupResponse ...
+type GroupResponse struct {
+	Group struct {
+		ID    int           `json:"id"`
+		Name  string        `json:"name"`
+		Users []RedmineUser `json:"users"`
+	} `json:"group"`
+}
 
-type CustomFieldIssueResponse struct {
-	Issue struct {
-		ID                int `json:"id"`
-		CustomFieldValues []struct {
-			ID    int    `json:"id"`
-			Name  string `json:"name"`
-			Value string `json:"value"`
-		} `json:"custom_fields"`
+// GetGroupUsers - Get members of Redmine group (admin only)
+func (rc *RedmineClient) GetGroupUsers(ctx context.Context, id int) (users []RedmineUser, err error) {
+	apiURL := rc.config.RedmineAPIHost + "groups/%d.json?include=users"
+	apiURL = fmt.Sprintf(apiURL, id)
+
+	cached := rc.cacheGet(apiURL)
+	if cached != nil {
+		users = cached.Value().([]RedmineUser)
+		return users, nil
+	}
+
+	res, err := rc.makeRequest(ctx, "GET", apiURL, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	group := new(GroupResponse)
+	err = res.ToJSON(group)
+	if err != nil {
+		return nil, err
 	}
+	users = group.Group.Users
+
+	rc.cache.Set(apiURL, users, 10*time.Minute)
+
+	return users, nil
 }
 
-func (rc *RedmineClient) GetAPIForCustomFields(id int) (customFields *CustomFieldIssueResponse, err error) {
-	var tempCustomFields *CustomFieldIssueResponse
+// IssueResponse ...
+type IssueResponse struct {
+	Issue Issue `json:"issue"`
+}
 
+// GetIssue - Get current state of the issue, not cached
+func (rc *RedmineClient) GetIssue(ctx context.Context, id int) (issue *Issue, err error) {
 	apiURL := rc.config.RedmineAPIHost + "issues/%d.json"
 	apiURL = fmt.Sprintf(apiURL, id)
 
-	cached := rc.cache.Get(apiURL)
-	if cached != nil {
-		customFields = cached.Value().(*CustomFieldIssueResponse)
-		return customFields, nil
+	res, err := rc.makeRequest(ctx, "GET", apiURL, nil, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	resp, err := rc.makeRequest("GET", apiURL, nil, nil)
+	response := new(IssueResponse)
+	err = res.ToJSON(response)
 	if err != nil {
 		return nil, err
 	}
+	return &response.Issue, nil
+}
 
-	tempCustomFields = new(CustomFieldIssueResponse)
-	err = resp.ToJSON(tempCustomFields)
-	customFields = tempCustomFields
-	rc.cache.Set(apiURL, customFields, 60*time.Minute)
+// IssuesResponse ...
+type IssuesResponse struct {
+	Issues     []Issue `json:"issues"`
+	TotalCount int     `json:"total_count"`
+	Limit      int     `json:"limit"`
+	Offset     int     `json:"offset"`
+}
 
-	return customFields, nil
+// GetUpdatedIssues - issues of any status updated at or after since, oldest first
+func (rc *RedmineClient) GetUpdatedIssues(ctx context.Context, since time.Time) (issues []Issue, err error) {
+	apiURL := rc.config.RedmineAPIHost + "issues.json"
+	filter := url.QueryEscape(">=" + since.UTC().Format(time.RFC3339))
+
+	offset := 0
+	limit := 100
+
+	for idx := 0; idx < 100; idx++ {
+		url := fmt.Sprintf("%s?status_id=*&updated_on=%s&sort=updated_on&limit=%d&offset=%d", apiURL, filter, limit, offset)
+		res, err := rc.makeRequest(ctx, "GET", url, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		page := new(IssuesResponse)
+		err = res.ToJSON(page)
+		if err != nil {
+			return nil, err
+		}
+
+		issues = append(issues, page.Issues...)
+		offset += limit
+		if len(page.Issues) == 0 || offset >= page.TotalCount {
+			break
+		}
+	}
+	return issues, nil
+}
+
+// APIJournal - journal as returned by the REST API, unlike the webhook Journal
+// it names the user and detail fields differently
+type APIJournal struct {
+	ID   int `json:"id"`
+	User struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	} `json:"user"`
+	Notes        string `json:"notes"`
+	CreatedOn    string `json:"created_on"`
+	PrivateNotes bool   `json:"private_notes"`
+	Details      []struct {
+		Property string      `json:"property"`
+		Name     string      `json:"name"`
+		OldValue interface{} `json:"old_value"`
+		NewValue interface{} `json:"new_value"`
+	} `json:"details"`
+}
+
+// Journal converts the journal to the webhook format, author is left for the caller
+func (j *APIJournal) Journal() Journal {
+	journal := Journal{
+		ID:           j.ID,
+		Author:       RedmineUser{ID: j.User.ID},
+		CreatedOn:    j.CreatedOn,
+		Notes:        j.Notes,
+		PrivateNotes: j.PrivateNotes,
+	}
+	for _, detail := range j.Details {
+		journal.Details = append(journal.Details, Detail{
+			OldValue: detail.OldValue,
+			PropKey:  detail.Name,
+			Property: detail.Property,
+			Value:    detail.NewValue,
+		})
+	}
+	return journal
+}
+
+type IssueJournalsResponse struct {
+	Issue struct {
+		Issue
+		Journals []APIJournal `json:"journals"`
+	} `json:"issue"`
+}
+
+// GetIssueJournals - Get the issue with its journals, not cached.
+// The issues list ignores include=journals, so journals are fetched per issue.
+func (rc *RedmineClient) GetIssueJournals(ctx context.Context, id int) (issue *Issue, journals []APIJournal, err error) {
+	apiURL := rc.config.RedmineAPIHost + "issues/%d.json?include=journals,watchers"
+	apiURL = fmt.Sprintf(apiURL, id)
+
+	res, err := rc.makeRequest(ctx, "GET", apiURL, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response := new(IssueJournalsResponse)
+	err = res.ToJSON(response)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &response.Issue.Issue, response.Issue.Journals, nil
+}
+
+// Функция для заполнения массива настраиваемых полей (Его выполнение Вы можете увидеть в main.go,
+// функция makeClientRequest)
+
+type CustomFieldIssueResponse struct {
+	Issue struct {
+		ID                int `json:"id"`
+		CustomFieldValues []struct {
+			ID    int    `json:"id"`
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"custom_fields"`
+	}
 }
 
-func (rc *RedmineClient) GetClientDataFromCustomFields(id int) (numPhone string, address string, err error) {
+func (rc *RedmineClient) GetAPIForCustomFields(ctx context.Context, id int) (customFields *CustomFieldIssueResponse, err error) {
 	var tempCustomFields *CustomFieldIssueResponse
 
 	apiURL := rc.config.RedmineAPIHost + "issues/%d.json"
 	apiURL = fmt.Sprintf(apiURL, id)
 
-	resp, err := rc.makeRequest("GET", apiURL, nil, nil)
+	// Not cached: custom fields change with every update of the issue
+	resp, err := rc.makeRequest(ctx, "GET", apiURL, nil, nil)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
 	tempCustomFields = new(CustomFieldIssueResponse)
 	err = resp.ToJSON(tempCustomFields)
-	for _, custom_field := range tempCustomFields.Issue.CustomFieldValues {
-		if custom_field.ID == 15 {
-			address = custom_field.Value;
-		}
-		if custom_field.ID == 19 {
-			numPhone = custom_field.Value;
-		}
+	if err != nil {
+		return nil, err
 	}
-	return numPhone, address, nil;
+	customFields = tempCustomFields
+
+	return customFields, nil
 }
 
 type UpdateIssueAPIResponse struct {
 	Issue struct {
-		StatusID  int       `json:"status_id"`
-		Notes     string    `json:"notes"`
+		StatusID int    `json:"status_id"`
+		Notes    string `json:"notes"`
 	} `json:"issue"`
 }
 
-func (rc *RedmineClient) UpdateStatusIssue(issueID int, postStatusID int) (newResponse string) {
+func (rc *RedmineClient) UpdateStatusIssue(ctx context.Context, issueID int, postStatusID int, notes string) (newResponse string, err error) {
 	updateAPI := new(UpdateIssueAPIResponse)
 	url := rc.config.RedmineAPIHost + "issues/%d.json"
 	url = fmt.Sprintf(url, issueID)
 
 	updateAPI.Issue.StatusID = postStatusID
-	if postStatusID == 5 {
-		updateAPI.Issue.Notes = "Заявка была закрыта!"
-	} else if postStatusID == 6 {
-		updateAPI.Issue.Notes = "Заявка была отклонена!"
-	} else if postStatusID == 9 {
-		updateAPI.Issue.Notes = "Заявка была подтверждена! Не забудьте связаться с абонентом по заявке."
-	}
+	updateAPI.Issue.Notes = notes
 
 	param := req.Param{
 		"issue": updateAPI.Issue,
 	}
-	res, err := rc.makeRequest("PUT", url, nil, param)
+	res, err := rc.makeRequest(ctx, "PUT", url, nil, param)
 	if err != nil {
-		fmt.Println("JSON Marshal Response Error:",err)
-		return ""
+		return "", err
 	}
 	newResponse = res.String()
 
-	return newResponse
-}
\ No newline at end of file
+	return newResponse, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMakeRequestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		call     func(rc *RedmineClient) error
+		requests int32
+	}{
+		{"GET is retried on 5xx", http.StatusBadGateway, func(rc *RedmineClient) error {
+			_, err := rc.GetIssue(context.Background(), 101)
+			return err
+		}, 3},
+		{"GET is not retried on 4xx", http.StatusNotFound, func(rc *RedmineClient) error {
+			_, err := rc.GetIssue(context.Background(), 101)
+			return err
+		}, 1},
+		{"PUT with notes is not retried", http.StatusBadGateway, func(rc *RedmineClient) error {
+			_, err := rc.UpdateStatusIssue(context.Background(), 101, 9, "note")
+			return err
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			var config Config
+			config.RedmineAPIHost = server.URL + "/"
+			config.Redmine.MaxRetries = 2
+			config.Redmine.RetryDelay = 1
+			if err := tt.call(NewRedmineClient(config)); err == nil {
+				t.Fatal("error expected")
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.requests {
+				t.Errorf("%d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
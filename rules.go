@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RoutingRule - extra recipients of notifications, declared in [[Rules]] of config.
+// Every condition that is set must match, a list matches if any of its values does.
+type RoutingRule struct {
+	Name         string
+	Actions      []string          // "opened", "updated"
+	Projects     []int             // project ids
+	Trackers     []int             // tracker ids
+	Priorities   []int             // priority ids
+	StatusFrom   []int             // status change from one of these statuses
+	StatusTo     []int             // status change to one of these, or status of a new issue
+	CustomFields map[string]string // custom field id -> value
+	NotesContain []string          // journal notes contain any of these, case-insensitive
+
+	// Targets
+	Users    []int    // Redmine user ids
+	Roles    []string // project members with one of these roles
+	Groups   []int    // Redmine group ids
+	Chats    []int64  // group or channel chat ids, settings of /register apply
+	Template string   // "staff" (default) or "client"
+}
+
+// ruleCondition - result of one condition, known is false when it depends
+// on an update that hasn't happened yet (see RuleResolver.Explain)
+type ruleCondition struct {
+	name  string
+	ok    bool
+	known bool
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// statusChange returns old and new status from the journal, if the status was changed
+func statusChange(event *IssueEvent) (from int, to int, ok bool) {
+	for _, detail := range event.Request.Payload.Journal.Details {
+		if detail.Property == "attr" && detail.PropKey == "status_id" {
+			from, _ = strconv.Atoi(fmt.Sprintf("%v", detail.OldValue))
+			to, _ = strconv.Atoi(fmt.Sprintf("%v", detail.Value))
+			return from, to, true
+		}
+	}
+	return 0, 0, false
+}
+
+// conditions evaluates the rule. With hypothetical set, conditions on the
+// journal are reported as unknown.
+func (rule *RoutingRule) conditions(event *IssueEvent, hypothetical bool) (conditions []ruleCondition) {
+	payload := event.Request.Payload
+	issue := payload.Issue
+
+	if len(rule.Actions) > 0 {
+		ok := false
+		for _, action := range rule.Actions {
+			ok = ok || action == payload.Action
+		}
+		conditions = append(conditions, ruleCondition{"Actions", ok, !hypothetical})
+	}
+	if len(rule.Projects) > 0 {
+		conditions = append(conditions, ruleCondition{"Projects", containsInt(rule.Projects, issue.Project.ID), true})
+	}
+	if len(rule.Trackers) > 0 {
+		conditions = append(conditions, ruleCondition{"Trackers", containsInt(rule.Trackers, issue.Tracker.ID), true})
+	}
+	if len(rule.Priorities) > 0 {
+		conditions = append(conditions, ruleCondition{"Priorities", containsInt(rule.Priorities, issue.Priority.ID), true})
+	}
+	from, to, changed := statusChange(event)
+	if len(rule.StatusFrom) > 0 {
+		conditions = append(conditions, ruleCondition{"StatusFrom", changed && containsInt(rule.StatusFrom, from), !hypothetical})
+	}
+	if len(rule.StatusTo) > 0 {
+		ok := changed && containsInt(rule.StatusTo, to)
+		if payload.Action == "opened" {
+			ok = containsInt(rule.StatusTo, issue.Status.ID)
+		}
+		conditions = append(conditions, ruleCondition{"StatusTo", ok, !hypothetical})
+	}
+	for id, value := range rule.CustomFields {
+		fieldID, _ := strconv.Atoi(id)
+		conditions = append(conditions, ruleCondition{"CustomFields." + id, customFieldValue(issue, fieldID) == value, true})
+	}
+	if len(rule.NotesContain) > 0 {
+		notes := strings.ToLower(payload.Journal.Notes)
+		ok := false
+		for _, part := range rule.NotesContain {
+			ok = ok || strings.Contains(notes, strings.ToLower(part))
+		}
+		conditions = append(conditions, ruleCondition{"NotesContain", ok, !hypothetical})
+	}
+	return conditions
+}
+
+func (rule *RoutingRule) matches(event *IssueEvent) bool {
+	for _, condition := range rule.conditions(event, false) {
+		if !condition.ok {
+			return false
+		}
+	}
+	return true
+}
+
+// RuleResolver - RecipientResolver for routing rules
+type RuleResolver struct {
+	rules   []RoutingRule
+	redmine IssueTracker
+	store   Store
+	i18n    *Translator
+}
+
+// NewRuleResolver ...
+func NewRuleResolver(rules []RoutingRule, redmine IssueTracker, store Store, i18n *Translator) *RuleResolver {
+	return &RuleResolver{
+		rules:   rules,
+		redmine: redmine,
+		store:   store,
+		i18n:    i18n,
+	}
+}
+
+func (r *RuleResolver) Resolve(ctx context.Context, event *IssueEvent) (recipients []Recipient, err error) {
+	for idx := range r.rules {
+		rule := &r.rules[idx]
+		if !rule.matches(event) {
+			continue
+		}
+		targets, err := r.targets(ctx, rule, event.Request.Payload.Issue.Project.ID)
+		if err != nil {
+			loggerFrom(ctx).Error("rule targets lookup failed", "rule", rule.Name, "err", err)
+		}
+		recipients = append(recipients, targets...)
+	}
+	return recipients, nil
+}
+
+// targets resolves users, roles, groups and chats of the rule, returning
+// as many recipients as could be found
+func (r *RuleResolver) targets(ctx context.Context, rule *RoutingRule, projectID int) (recipients []Recipient, err error) {
+	template := rule.Template
+	if template == "" {
+		template = staffTemplate
+	}
+
+	redmineIDs := append([]int(nil), rule.Users...)
+	if len(rule.Roles) > 0 {
+		members, membersErr := r.redmine.GetMembershipsByProject(ctx, projectID)
+		if membersErr != nil {
+			err = membersErr
+		} else {
+			for _, member := range members.Users {
+				for _, role := range member.Roles {
+					for _, name := range rule.Roles {
+						if strings.EqualFold(role.Name, name) {
+							redmineIDs = append(redmineIDs, member.User.ID)
+						}
+					}
+				}
+			}
+		}
+	}
+	for _, group := range rule.Groups {
+		users, groupErr := r.redmine.GetGroupUsers(ctx, group)
+		if groupErr != nil {
+			err = groupErr
+			continue
+		}
+		for _, user := range users {
+			redmineIDs = append(redmineIDs, user.ID)
+		}
+	}
+
+	if len(redmineIDs) > 0 {
+		users, usersErr := r.store.GetUsersByRedmineIDs(redmineIDs)
+		if usersErr != nil {
+			return nil, usersErr
+		}
+		for _, user := range users {
+			recipients = append(recipients, Recipient{User: user, Template: template})
+		}
+	}
+	for _, chat := range rule.Chats {
+		user, chatErr := chatUser(r.store, chat)
+		if chatErr != nil {
+			err = chatErr
+			continue
+		}
+		if user.ChatFailed {
+			loggerFrom(ctx).Debug("unavailable rule chat skipped", "rule", rule.Name, "chat", chat)
+			continue
+		}
+		recipients = append(recipients, Recipient{User: user, Template: template})
+	}
+	return recipients, err
+}
+
+// Explain describes which rules fire for the current state of the issue
+func (r *RuleResolver) Explain(ctx context.Context, issueID int, lang string) (string, error) {
+	issue, err := r.redmine.GetIssue(ctx, issueID)
+	if err != nil {
+		return "", err
+	}
+	event := &IssueEvent{Request: RedmineRequest{Payload: Payload{Action: "updated", Issue: *issue}}}
+
+	lines := []string{r.i18n.T(lang, "rules.header", issueID)}
+	if len(r.rules) == 0 {
+		lines = append(lines, r.i18n.T(lang, "rules.none"))
+	}
+	for idx := range r.rules {
+		rule := &r.rules[idx]
+		name := rule.Name
+		if name == "" {
+			name = strconv.Itoa(idx + 1)
+		}
+		var failed, unknown []string
+		for _, condition := range rule.conditions(event, true) {
+			switch {
+			case !condition.known:
+				unknown = append(unknown, condition.name)
+			case !condition.ok:
+				failed = append(failed, condition.name)
+			}
+		}
+		switch {
+		case len(failed) > 0:
+			lines = append(lines, r.i18n.T(lang, "rules.skipped", name, strings.Join(failed, ", ")))
+		case len(unknown) > 0:
+			lines = append(lines, r.i18n.T(lang, "rules.depends", name, strings.Join(unknown, ", ")))
+		default:
+			lines = append(lines, r.i18n.T(lang, "rules.fires", name))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRuleChats(t *testing.T) {
+	store := newTestStore(t)
+	if _, err := store.RegisterGroupChat(-1001, "Диспетчерская", "supergroup", "en"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RegisterGroupChat(-1002, "Архив", "group", "ru"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkChatUnavailable(-1002, "Forbidden: bot was kicked from the group chat"); err != nil {
+		t.Fatal(err)
+	}
+	resolver := NewRuleResolver(nil, nil, store, nil)
+	rule := &RoutingRule{Name: "chats", Chats: []int64{-1001, -1002, -1003}}
+
+	recipients, err := resolver.targets(context.Background(), rule, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]string{-1001: "en", -1003: ""}
+	if len(recipients) != len(want) {
+		t.Fatalf("%d recipients, want %d", len(recipients), len(want))
+	}
+	for _, recipient := range recipients {
+		lang, ok := want[recipient.User.Chat]
+		if !ok {
+			t.Errorf("unexpected recipient %d", recipient.User.Chat)
+		} else if recipient.User.Language != lang {
+			t.Errorf("chat %d language %q, want %q", recipient.User.Chat, recipient.User.Language, lang)
+		}
+	}
+}
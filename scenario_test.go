@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Scenario - webhook payloads and button presses replayed against fake
+// Redmine and Telegram, with expected outgoing messages and Redmine writes.
+// See testdata/scenarios for examples.
+type Scenario struct {
+	Description string `json:"description"`
+	// Config - overrides of Config fields, e.g. {"LongMessages": "truncate"}
+	Config           json.RawMessage  `json:"config"`
+	Redmine          RedmineFixtures  `json:"redmine"`
+	TelegramFailures map[int64]string `json:"telegram_failures"`
+	Users            []ScenarioUser   `json:"users"`
+	Steps            []ScenarioStep   `json:"steps"`
+	Expect           ScenarioExpect   `json:"expect"`
+}
+
+// ScenarioUser - bot user registered before the scenario starts
+type ScenarioUser struct {
+	Chat      int64  `json:"chat"`
+	TGUser    int    `json:"tg_user"`
+	Phone     string `json:"phone"`
+	IsAdmin   bool   `json:"is_admin"`
+	RedmineID int    `json:"redmine_id"`
+	Language  string `json:"language"`
+}
+
+// ScenarioStep - a webhook, a button press, a text message to the bot or a poll of Redmine.
+// Webhook is an inline payload or a path relative to the scenario file.
+type ScenarioStep struct {
+	Webhook  json.RawMessage `json:"webhook"`
+	Callback *struct {
+		ScenarioChat
+		Data string `json:"data"`
+	} `json:"callback"`
+	Message *struct {
+		ScenarioChat
+		Text string `json:"text"`
+	} `json:"message"`
+	// Poll runs IssuePoller once, Since sets its checkpoint first
+	Poll *struct {
+		Since string `json:"since"`
+	} `json:"poll"`
+}
+
+// ScenarioChat - where an update comes from. Private chat by default,
+// a non-empty Group makes it a supergroup with that title.
+type ScenarioChat struct {
+	Chat   int64  `json:"chat"`
+	From   int    `json:"from"` // Telegram user, defaults to Chat
+	Thread int    `json:"thread"`
+	Group  string `json:"group"`
+}
+
+func (c ScenarioChat) chat() (*tgbotapi.Chat, *tgbotapi.User) {
+	from := c.From
+	if from == 0 {
+		from = int(c.Chat)
+	}
+	chat := &tgbotapi.Chat{ID: c.Chat, Type: "private"}
+	if c.Group != "" {
+		chat.Type, chat.Title = "supergroup", c.Group
+	}
+	return chat, &tgbotapi.User{ID: from}
+}
+
+// scenarioMessage builds an incoming message, "/command" text is marked as a command
+func scenarioMessage(source ScenarioChat, text string) *tgbotapi.Message {
+	chat, from := source.chat()
+	message := &tgbotapi.Message{
+		From: from,
+		Chat: chat,
+		Text: text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := len(strings.Fields(text)[0])
+		message.Entities = &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return message
+}
+
+// ScenarioExpect - every sent message must match exactly one expected message
+type ScenarioExpect struct {
+	Messages []struct {
+		Chat        int64    `json:"chat"`
+		Thread      int      `json:"thread"`
+		Text        string   `json:"text"`
+		Contains    []string `json:"contains"`
+		NotContains []string `json:"not_contains"`
+	} `json:"messages"`
+	RedmineWrites []struct {
+		Method   string   `json:"method"`
+		Path     string   `json:"path"`
+		Contains []string `json:"contains"`
+	} `json:"redmine_writes"`
+}
+
+func matchText(text string, exact string, contains []string, notContains []string) bool {
+	if exact != "" && text != exact {
+		return false
+	}
+	for _, part := range contains {
+		if !strings.Contains(text, part) {
+			return false
+		}
+	}
+	for _, part := range notContains {
+		if strings.Contains(text, part) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Scenario) check(sent []SentMessage, writes []RecordedRequest) (problems []string) {
+	used := make([]bool, len(sent))
+	for idx, expected := range s.Expect.Messages {
+		found := false
+		for sentIdx, message := range sent {
+			if used[sentIdx] || message.ChatID != expected.Chat || message.ThreadID != expected.Thread {
+				continue
+			}
+			if matchText(message.Text, expected.Text, expected.Contains, expected.NotContains) {
+				used[sentIdx], found = true, true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("expected message #%d to chat %d was not sent", idx+1, expected.Chat))
+		}
+	}
+	for idx, message := range sent {
+		if !used[idx] {
+			problems = append(problems, fmt.Sprintf("unexpected message to chat %d:\n%s", message.ChatID, message.Text))
+		}
+	}
+
+	if len(writes) != len(s.Expect.RedmineWrites) {
+		problems = append(problems, fmt.Sprintf("expected %d Redmine write(s), got %d: %v", len(s.Expect.RedmineWrites), len(writes), writes))
+		return problems
+	}
+	for idx, expected := range s.Expect.RedmineWrites {
+		write := writes[idx]
+		if write.Method != expected.Method || write.Path != expected.Path || !matchText(write.Body, "", expected.Contains, nil) {
+			problems = append(problems, fmt.Sprintf("Redmine write #%d: expected %s %s %v, got %s %s %s",
+				idx+1, expected.Method, expected.Path, expected.Contains, write.Method, write.Path, write.Body))
+		}
+	}
+	return problems
+}
+
+// loadStepPayload resolves webhook of a step into RedmineRequest
+func loadStepPayload(config Config, dir string, raw json.RawMessage) (*RedmineRequest, error) {
+	var source string
+	if err := json.Unmarshal(raw, &source); err != nil {
+		request := new(RedmineRequest)
+		return request, json.Unmarshal(raw, request)
+	}
+	if !filepath.IsAbs(source) {
+		source = filepath.Join(dir, source)
+	}
+	return loadPreviewPayload(config, source)
+}
+
+// runScenario replays one scenario file, base config is used for templates
+// and locales, never for Redmine or Telegram access
+func runScenario(base Config, path string) (problems []string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	scenario := new(Scenario)
+	if err := json.Unmarshal(data, scenario); err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "scenario")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	redmineFake := NewFakeRedmine(scenario.Redmine, "scenario-token")
+	defer redmineFake.Close()
+	telegramFake := NewFakeTelegram(scenario.TelegramFailures)
+	defer telegramFake.Close()
+
+	config := base
+	config.DbFile = filepath.Join(tmpDir, "scenario.db")
+	config.TgToken = "scenario"
+	config.RedmineHost = "https://redmine.example/"
+	config.RedmineAPIHost = redmineFake.URL()
+	config.RedmineToken = "scenario-token"
+	config.Proxy = ProxyConfig{}
+	config.QuietHours = QuietHoursConfig{}
+	config.RateLimit = RateLimitConfig{GlobalPerSecond: 1000, ChatPerSecond: 1000, MaxRetries: 1}
+	config.Redmine = RedmineClientConfig{Timeout: 5, MaxRetries: 1, RetryDelay: 10}
+	if len(scenario.Config) > 0 {
+		if err := json.Unmarshal(scenario.Config, &config); err != nil {
+			return nil, err
+		}
+	}
+
+	db := NewDBInstance(config.DbFile)
+	defer db.Close()
+	ProcessMigrations(db)
+	for _, user := range scenario.Users {
+		err := db.Create(&User{
+			Chat:      user.Chat,
+			TGUser:    user.TGUser,
+			Phone:     user.Phone,
+			IsAdmin:   user.IsAdmin,
+			RedmineID: user.RedmineID,
+			Language:  user.Language,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	i18n, err := LoadTranslator(config.LocalesDir, config.DefaultLanguage)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := loadTemplates(config, i18n.Languages())
+	if err != nil {
+		return nil, err
+	}
+	bot, err := tgbotapi.NewBotAPIWithClient(config.TgToken, telegramFake.Client())
+	if err != nil {
+		return nil, err
+	}
+
+	issueUpdates := make(chan QueuedEvent, len(scenario.Steps)+1)
+	redmine := NewRedmineClient(config)
+	store := NewDBStore(db)
+	sender := NewSender(config, bot, store, i18n)
+	notifier := NewNotifier(config, sender, store)
+	handler := NewIssuesHandler(config, redmine, store, notifier, templates, i18n, issueUpdates)
+	rules := NewRuleResolver(config.Rules, redmine, store, i18n)
+	handler.AddResolver(rules)
+	server, _ := initHTTPServer(config, handler, nil)
+	authHandler := NewAuthHandler(config, store, bot, i18n, rules)
+	groupHandler := NewGroupHandler(store, bot, redmine, i18n)
+	issuePoller := NewIssuePoller(config, redmine, store, handler)
+	dispatcher := newDispatcher(config, redmine, sender, authHandler, groupHandler)
+	go handler.Run()
+	defer handler.Shutdown(context.Background())
+
+	dir := filepath.Dir(path)
+	for idx, step := range scenario.Steps {
+		switch {
+		case len(step.Webhook) > 0:
+			request, err := loadStepPayload(base, dir, step.Webhook)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: %v", idx+1, err)
+			}
+			body, _ := json.Marshal(request)
+			httpRequest := httptest.NewRequest("POST", "/webhook", bytes.NewReader(body))
+			httpRequest.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httpRequest)
+			if recorder.Code != http.StatusOK {
+				problems = append(problems, fmt.Sprintf("step %d: webhook answered %d", idx+1, recorder.Code))
+			}
+			problems = append(problems, waitEvents(idx, store)...)
+		case step.Poll != nil:
+			if step.Poll.Since != "" {
+				checkpoint, err := store.GetCheckpoint(pollerCheckpoint)
+				if err != nil {
+					checkpoint = &Checkpoint{Name: pollerCheckpoint}
+				}
+				checkpoint.Value = parseRedmineTime(step.Poll.Since)
+				if err := store.SaveCheckpoint(checkpoint); err != nil {
+					return nil, err
+				}
+			}
+			if err := issuePoller.poll(context.Background()); err != nil {
+				problems = append(problems, fmt.Sprintf("step %d: poll: %v", idx+1, err))
+			}
+			problems = append(problems, waitEvents(idx, store)...)
+		case step.Callback != nil:
+			chat, from := step.Callback.chat()
+			update := TelegramUpdate{ThreadID: step.Callback.Thread}
+			update.CallbackQuery = &tgbotapi.CallbackQuery{
+				ID:      fmt.Sprintf("scenario-%d", idx+1),
+				From:    from,
+				Message: &tgbotapi.Message{Chat: chat},
+				Data:    step.Callback.Data,
+			}
+			dispatcher.Dispatch(update)
+		case step.Message != nil:
+			update := TelegramUpdate{ThreadID: step.Message.Thread}
+			update.Message = scenarioMessage(step.Message.ScenarioChat, step.Message.Text)
+			dispatcher.Dispatch(update)
+		default:
+			return nil, fmt.Errorf("step %d: neither webhook, callback, message nor poll", idx+1)
+		}
+	}
+
+	return append(problems, scenario.check(telegramFake.Sent(), redmineFake.Writes())...), nil
+}
+
+// waitEvents waits until the workers of IssuesHandler.Run have processed
+// every stored event, so the next step sees their messages
+func waitEvents(idx int, store Store) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count, err := store.CountPendingWebhookEvents()
+		if err != nil {
+			return []string{fmt.Sprintf("step %d: pending events: %v", idx+1, err)}
+		}
+		if count == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return []string{fmt.Sprintf("step %d: %d events still pending", idx+1, count)}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestScenarios runs every testdata/scenarios/*.json as a subtest
+func TestScenarios(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "scenarios", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no scenarios in testdata/scenarios")
+	}
+	sort.Strings(files)
+
+	config := parseConfig("config.example.toml")
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			problems, err := runScenario(config, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, problem := range problems {
+				t.Error(problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var ErrChatUnavailable = errors.New("Chat is unavailable")
+
+// Telegram error descriptions meaning the chat will never accept messages again
+var permanentChatErrors = []string{
+	"bot was blocked by the user",
+	"bot was kicked",
+	"chat not found",
+	"user is deactivated",
+	"have no rights to send a message",
+}
+
+// Descriptions of 4xx Bot API errors start with the status text, a retry gets
+// the same answer. Other errors (5xx, network) are transient.
+var clientErrorPrefixes = []string{
+	"bad request",
+	"unauthorized",
+	"forbidden",
+	"not found",
+	"conflict",
+}
+
+// tokenBucket - simple blocking rate limiter
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	rate     float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64, capacity float64) *tokenBucket {
+	return &tokenBucket{
+		tokens:   capacity,
+		capacity: capacity,
+		rate:     rate,
+		last:     time.Now(),
+	}
+}
+
+func (b *tokenBucket) wait() {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(delay)
+	}
+}
+
+// Messenger - Telegram Bot API used by the bot, implemented by tgbotapi.BotAPI
+type Messenger interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error)
+	MakeRequest(endpoint string, params url.Values) (tgbotapi.APIResponse, error)
+}
+
+// DeliveryReport - outcome of a single send through Sender
+type DeliveryReport struct {
+	ChatID   int64
+	Message  tgbotapi.Message
+	Attempts int
+	Status   string
+	Err      error
+}
+
+// Statuses of DeliveryReport, Delivery also uses queued and deferred
+const (
+	DeliveryQueued          = "queued"
+	DeliveryDeferred        = "deferred"
+	DeliverySent            = "sent"
+	DeliveryFailed          = "failed"
+	DeliveryChatUnavailable = "chat_unavailable"
+)
+
+// Sender - wraps BotAPI with global and per-chat rate limits and retries
+type Sender struct {
+	bot        Messenger
+	store      Store
+	global     *tokenBucket
+	chatRate   float64
+	maxRetries int
+	retryDelay time.Duration // before the first retry, doubled after each one
+	truncate   bool
+	i18n       *Translator
+
+	mu    sync.Mutex
+	chats map[int64]*tokenBucket
+}
+
+// NewSender ...
+func NewSender(config Config, bot Messenger, store Store, i18n *Translator) *Sender {
+	limits := config.RateLimit
+	if limits.GlobalPerSecond <= 0 {
+		limits.GlobalPerSecond = 30
+	}
+	if limits.ChatPerSecond <= 0 {
+		limits.ChatPerSecond = 1
+	}
+	if limits.MaxRetries <= 0 {
+		limits.MaxRetries = 3
+	}
+	return &Sender{
+		bot:        bot,
+		store:      store,
+		global:     newTokenBucket(limits.GlobalPerSecond, limits.GlobalPerSecond),
+		chatRate:   limits.ChatPerSecond,
+		maxRetries: limits.MaxRetries,
+		retryDelay: time.Second,
+		truncate:   config.LongMessages == "truncate",
+		i18n:       i18n,
+		chats:      make(map[int64]*tokenBucket),
+	}
+}
+
+func (s *Sender) chatBucket(chatID int64) *tokenBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, ok := s.chats[chatID]
+	if !ok {
+		bucket = newTokenBucket(s.chatRate, 1)
+		s.chats[chatID] = bucket
+	}
+	return bucket
+}
+
+func chatIDOf(c tgbotapi.Chattable) int64 {
+	switch config := c.(type) {
+	case tgbotapi.MessageConfig:
+		return config.ChatID
+	case ThreadMessage:
+		return config.ChatID
+	case tgbotapi.EditMessageTextConfig:
+		return config.ChatID
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		return config.ChatID
+	}
+	return 0
+}
+
+func isPermanentChatError(err error) bool {
+	tgErr, ok := err.(tgbotapi.Error)
+	if !ok {
+		return false
+	}
+	description := strings.ToLower(tgErr.Message)
+	for _, reason := range permanentChatErrors {
+		if strings.Contains(description, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+func isClientError(err tgbotapi.Error) bool {
+	description := strings.ToLower(err.Message)
+	for _, prefix := range clientErrorPrefixes {
+		if strings.HasPrefix(description, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Send has the same signature as BotAPI.Send, buttons added by Sender use the default language
+func (s *Sender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	report := s.Deliver(context.Background(), c, "")
+	return report.Message, report.Err
+}
+
+// Deliver sends c honouring rate limits and retry_after, retrying transient errors.
+// Messages over the Telegram length limit are split or truncated. Sends are
+// logged with the fields of ctx. lang is the language of the recipient, used
+// for the "show full" button of a truncated message.
+func (s *Sender) Deliver(ctx context.Context, c tgbotapi.Chattable, lang string) DeliveryReport {
+	var (
+		message  tgbotapi.MessageConfig
+		threadID int
+	)
+	switch config := c.(type) {
+	case tgbotapi.MessageConfig:
+		message = config
+	case ThreadMessage:
+		message, threadID = config.MessageConfig, config.ThreadID
+	default:
+		return s.deliver(ctx, c)
+	}
+	if utf8.RuneCountInString(message.Text) > maxMessageLength {
+		if s.truncate {
+			return s.deliverTruncated(ctx, message, threadID, lang)
+		}
+		return s.deliverParts(ctx, message, threadID)
+	}
+	return s.deliver(ctx, c)
+}
+
+func isHTML(parseMode string) bool {
+	return strings.EqualFold(parseMode, tgbotapi.ModeHTML)
+}
+
+// deliverParts sends every part of a long message, keyboard goes with the last one
+func (s *Sender) deliverParts(ctx context.Context, message tgbotapi.MessageConfig, threadID int) (report DeliveryReport) {
+	parts := splitMessage(message.Text, maxMessageLength, isHTML(message.ParseMode))
+	attempts := 0
+	for idx, text := range parts {
+		part := message
+		part.Text = text
+		if idx < len(parts)-1 {
+			part.ReplyMarkup = nil
+		}
+		report = s.deliver(ctx, withThread(part, threadID))
+		attempts += report.Attempts
+		if report.Status != DeliverySent {
+			break
+		}
+	}
+	report.Attempts = attempts
+	return report
+}
+
+const fullTextCallbackPrefix = "full:"
+
+// deliverTruncated sends the first part with a button that requests the rest
+func (s *Sender) deliverTruncated(ctx context.Context, message tgbotapi.MessageConfig, threadID int, lang string) DeliveryReport {
+	stored, err := s.store.CreateLongMessage(message.ChatID, threadID, message.Text, message.ParseMode)
+	if err != nil {
+		loggerFrom(ctx).Error("long message save failed", "chat", message.ChatID, "err", err)
+		return s.deliverParts(ctx, message, threadID)
+	}
+
+	parts := splitMessage(message.Text, maxMessageLength-1, isHTML(message.ParseMode))
+	message.Text = parts[0] + "…"
+
+	button := tgbotapi.NewInlineKeyboardButtonData(
+		s.i18n.T(s.i18n.Language(lang), "keyboard.show_full"),
+		fullTextCallbackPrefix+strconv.Itoa(int(stored.ID)),
+	)
+	switch kb := message.ReplyMarkup.(type) {
+	case *tgbotapi.InlineKeyboardMarkup:
+		markup := *kb
+		markup.InlineKeyboard = append(markup.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(button))
+		message.ReplyMarkup = markup
+	case tgbotapi.InlineKeyboardMarkup:
+		kb.InlineKeyboard = append(kb.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(button))
+		message.ReplyMarkup = kb
+	default:
+		message.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(button))
+	}
+	return s.deliver(ctx, withThread(message, threadID))
+}
+
+// SendFullText answers "show full" button with the rest of a truncated message
+func (s *Sender) SendFullText(query *tgbotapi.CallbackQuery) error {
+	s.bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
+
+	id, err := strconv.Atoi(strings.TrimPrefix(query.Data, fullTextCallbackPrefix))
+	if err != nil {
+		return err
+	}
+	stored, err := s.store.GetLongMessage(id)
+	if err != nil {
+		return err
+	}
+	// The id comes from the client, a forged one must not reveal another chat's text
+	if query.Message == nil || stored.Chat != query.Message.Chat.ID {
+		return fmt.Errorf("long message %d belongs to another chat", id)
+	}
+
+	parts := splitMessage(stored.Text, maxMessageLength-1, isHTML(stored.ParseMode))
+	for _, text := range parts[1:] {
+		message := tgbotapi.NewMessage(query.Message.Chat.ID, text)
+		message.ParseMode = stored.ParseMode
+		if report := s.deliver(context.Background(), withThread(message, stored.ThreadID)); report.Err != nil {
+			return report.Err
+		}
+	}
+	return nil
+}
+
+func (s *Sender) deliver(ctx context.Context, c tgbotapi.Chattable) (report DeliveryReport) {
+	report.ChatID = chatIDOf(c)
+	backoff := s.retryDelay
+	log := loggerFrom(ctx).With("chat", report.ChatID)
+
+	for report.Attempts < s.maxRetries+1 {
+		report.Attempts++
+		if report.ChatID != 0 {
+			s.chatBucket(report.ChatID).wait()
+		}
+		s.global.wait()
+
+		if message, ok := c.(ThreadMessage); ok {
+			report.Message, report.Err = sendThreadMessage(s.bot, message)
+		} else {
+			report.Message, report.Err = s.bot.Send(c)
+		}
+		if report.Err == nil {
+			report.Status = DeliverySent
+			log.Debug("message sent", "message", report.Message.MessageID, "attempts", report.Attempts)
+			return report
+		}
+
+		if isPermanentChatError(report.Err) {
+			report.Status = DeliveryChatUnavailable
+			if err := s.store.MarkChatUnavailable(report.ChatID, report.Err.Error()); err != nil {
+				log.Error("chat update failed", "err", err)
+			}
+			log.Warn("chat unavailable", "err", report.Err)
+			return report
+		}
+		log.Debug("send failed, retrying", "attempt", report.Attempts, "err", report.Err)
+
+		if tgErr, ok := report.Err.(tgbotapi.Error); ok {
+			if tgErr.RetryAfter > 0 {
+				time.Sleep(time.Duration(tgErr.RetryAfter) * time.Second)
+				continue
+			}
+			if isClientError(tgErr) {
+				break
+			}
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	report.Status = DeliveryFailed
+	log.Error("delivery failed", "attempts", report.Attempts, "err", report.Err)
+	return report
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// stubMessenger returns errs for successive sends and records what was sent
+type stubMessenger struct {
+	Messenger
+	mu   sync.Mutex
+	errs []error
+	sent []tgbotapi.MessageConfig
+}
+
+func (m *stubMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+	}
+	message := c.(tgbotapi.MessageConfig)
+	m.sent = append(m.sent, message)
+	return tgbotapi.Message{MessageID: len(m.sent), Chat: &tgbotapi.Chat{ID: message.ChatID}}, nil
+}
+
+func (m *stubMessenger) AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error) {
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func newTestSender(t *testing.T, store Store, bot Messenger, config Config) *Sender {
+	t.Helper()
+	i18n, err := LoadTranslator("locales", "ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RateLimit = RateLimitConfig{GlobalPerSecond: 1000, ChatPerSecond: 1000, MaxRetries: 2}
+	sender := NewSender(config, bot, store, i18n)
+	sender.retryDelay = time.Millisecond
+	return sender
+}
+
+func TestDeliverRetries(t *testing.T) {
+	serverError := tgbotapi.Error{Message: "Internal Server Error"}
+	tests := []struct {
+		name     string
+		errs     []error
+		status   string
+		attempts int
+	}{
+		{"sent", nil, DeliverySent, 1},
+		{"server error is retried", []error{serverError}, DeliverySent, 2},
+		{"network error is retried", []error{errors.New("connection reset"), errors.New("timeout")}, DeliverySent, 3},
+		{"retries run out", []error{serverError, serverError, serverError}, DeliveryFailed, 3},
+		{"bad request is not retried", []error{tgbotapi.Error{Message: "Bad Request: can't parse entities"}}, DeliveryFailed, 1},
+		{"blocked chat", []error{tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"}}, DeliveryChatUnavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			if err := store.db.Create(&User{Chat: 300, TGUser: 300}).Error; err != nil {
+				t.Fatal(err)
+			}
+			bot := &stubMessenger{errs: tt.errs}
+			report := newTestSender(t, store, bot, Config{}).Deliver(context.Background(), tgbotapi.NewMessage(300, "text"), "")
+			if report.Status != tt.status || report.Attempts != tt.attempts {
+				t.Errorf("%s after %d attempts, want %s after %d: %v", report.Status, report.Attempts, tt.status, tt.attempts, report.Err)
+			}
+			user, err := store.GetUserByChatID(300)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.ChatFailed != (tt.status == DeliveryChatUnavailable) {
+				t.Errorf("chat failed %v", user.ChatFailed)
+			}
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(100, 2)
+	started := time.Now()
+	bucket.wait()
+	bucket.wait()
+	if elapsed := time.Since(started); elapsed > 5*time.Millisecond {
+		t.Errorf("burst of capacity waited %v", elapsed)
+	}
+	for i := 0; i < 5; i++ {
+		bucket.wait()
+	}
+	// 5 more tokens at 100 per second
+	if elapsed := time.Since(started); elapsed < 40*time.Millisecond {
+		t.Errorf("5 tokens over capacity took only %v", elapsed)
+	}
+}
+
+func TestDeliverLongMessage(t *testing.T) {
+	long := strings.Repeat("слово ", 1000)
+	tests := []struct {
+		name     string
+		mode     string
+		messages int
+	}{
+		{"split", "split", 2},
+		{"truncate", "truncate", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bot := &stubMessenger{}
+			sender := newTestSender(t, newTestStore(t), bot, Config{LongMessages: tt.mode})
+			report := sender.Deliver(context.Background(), tgbotapi.NewMessage(300, long), "en")
+			if report.Status != DeliverySent {
+				t.Fatal(report.Err)
+			}
+			if len(bot.sent) != tt.messages {
+				t.Fatalf("%d messages sent, want %d", len(bot.sent), tt.messages)
+			}
+			for _, message := range bot.sent {
+				if size := len([]rune(message.Text)); size > maxMessageLength {
+					t.Errorf("message of %d characters", size)
+				}
+			}
+		})
+	}
+}
+
+func TestSendFullText(t *testing.T) {
+	bot := &stubMessenger{}
+	store := newTestStore(t)
+	sender := newTestSender(t, store, bot, Config{LongMessages: "truncate"})
+	long := strings.Repeat("слово ", 1000)
+	if report := sender.Deliver(context.Background(), tgbotapi.NewMessage(300, long), "en"); report.Status != DeliverySent {
+		t.Fatal(report.Err)
+	}
+	first := bot.sent[0]
+	if !strings.HasSuffix(first.Text, "…") {
+		t.Errorf("truncated text doesn't end with …")
+	}
+	markup, ok := first.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
+	if !ok || len(markup.InlineKeyboard) != 1 {
+		t.Fatalf("keyboard %#v", first.ReplyMarkup)
+	}
+	button := markup.InlineKeyboard[0][0]
+	if button.Text != "Show full text" || button.CallbackData == nil {
+		t.Fatalf("button %q", button.Text)
+	}
+
+	tests := []struct {
+		name string
+		chat int64
+		data string
+		ok   bool
+		sent int
+	}{
+		{"another chat", 400, *button.CallbackData, false, 1},
+		{"unknown message", 300, fullTextCallbackPrefix + "999", false, 1},
+		{"recipient", 300, *button.CallbackData, true, 2},
+	}
+	for _, tt := range tests {
+		query := &tgbotapi.CallbackQuery{ID: "1", Data: tt.data, Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: tt.chat}}}
+		if err := sender.SendFullText(query); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if len(bot.sent) != tt.sent {
+			t.Errorf("%s: %d messages sent, want %d", tt.name, len(bot.sent), tt.sent)
+		}
+	}
+}
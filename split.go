@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// Telegram limit for message text
+const maxMessageLength = 4096
+
+// htmlToken - a tag, an entity or a single character of text
+type htmlToken struct {
+	text    string
+	size    int
+	tag     string
+	closing bool
+}
+
+func tokenizeHTML(text string, html bool) (tokens []htmlToken) {
+	for len(text) > 0 {
+		if html && text[0] == '<' {
+			if end := strings.IndexByte(text, '>'); end > 0 {
+				raw := text[:end+1]
+				name := strings.TrimPrefix(raw[1:end], "/")
+				if idx := strings.IndexAny(name, " \t\n"); idx >= 0 {
+					name = name[:idx]
+				}
+				tokens = append(tokens, htmlToken{
+					text:    raw,
+					size:    utf8.RuneCountInString(raw),
+					tag:     strings.ToLower(name),
+					closing: raw[1] == '/',
+				})
+				text = text[end+1:]
+				continue
+			}
+		}
+		if html && text[0] == '&' {
+			if end := strings.IndexByte(text, ';'); end > 0 && end <= 10 {
+				tokens = append(tokens, htmlToken{text: text[:end+1], size: 1})
+				text = text[end+1:]
+				continue
+			}
+		}
+		_, width := utf8.DecodeRuneInString(text)
+		tokens = append(tokens, htmlToken{text: text[:width], size: 1})
+		text = text[width:]
+	}
+	return tokens
+}
+
+func nextTagStack(stack []htmlToken, token htmlToken) []htmlToken {
+	if token.tag == "" {
+		return stack
+	}
+	if !token.closing {
+		next := make([]htmlToken, len(stack), len(stack)+1)
+		copy(next, stack)
+		return append(next, token)
+	}
+	for idx := len(stack) - 1; idx >= 0; idx-- {
+		if stack[idx].tag == token.tag {
+			next := make([]htmlToken, idx)
+			copy(next, stack[:idx])
+			return next
+		}
+	}
+	return stack
+}
+
+func closingTagsSize(stack []htmlToken) (size int) {
+	for _, open := range stack {
+		size += len(open.tag) + 3
+	}
+	return size
+}
+
+func closeTags(buf *bytes.Buffer, stack []htmlToken) {
+	for idx := len(stack) - 1; idx >= 0; idx-- {
+		buf.WriteString("</" + stack[idx].tag + ">")
+	}
+}
+
+// splitMessage cuts text into parts of at most limit characters, preferring line breaks
+// and then spaces.
+// In html mode tags and entities are never broken: open tags are closed at the end
+// of a part and reopened at the beginning of the next one.
+func splitMessage(text string, limit int, html bool) []string {
+	if utf8.RuneCountInString(text) <= limit {
+		return []string{text}
+	}
+
+	type checkpoint struct {
+		index  int
+		length int
+		stack  []htmlToken
+	}
+
+	var (
+		parts      []string
+		stack      []htmlToken
+		buf        bytes.Buffer
+		size       int
+		chunkStart int
+		lineBreak  *checkpoint
+		wordBreak  *checkpoint
+	)
+
+	begin := func() {
+		buf.Reset()
+		size = 0
+		lineBreak = nil
+		wordBreak = nil
+		for _, open := range stack {
+			buf.WriteString(open.text)
+			size += open.size
+		}
+	}
+	finish := func() {
+		closeTags(&buf, stack)
+		if part := strings.TrimSpace(buf.String()); part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	tokens := tokenizeHTML(text, html)
+	begin()
+	for idx := 0; idx < len(tokens); idx++ {
+		token := tokens[idx]
+		next := nextTagStack(stack, token)
+		if size+token.size+closingTagsSize(next) > limit && idx > chunkStart {
+			// A line break too close to the beginning would leave a tiny part
+			cut := lineBreak
+			if cut == nil || cut.length < buf.Len()/2 && wordBreak != nil && wordBreak.length > cut.length {
+				cut = wordBreak
+			}
+			if cut != nil {
+				buf.Truncate(cut.length)
+				stack = cut.stack
+				idx = cut.index
+			} else {
+				idx--
+			}
+			finish()
+			begin()
+			chunkStart = idx + 1
+			continue
+		}
+		buf.WriteString(token.text)
+		size += token.size
+		stack = next
+		switch token.text {
+		case "\n":
+			lineBreak = &checkpoint{index: idx, length: buf.Len(), stack: stack}
+		case " ":
+			wordBreak = &checkpoint{index: idx, length: buf.Len(), stack: stack}
+		}
+	}
+	finish()
+	return parts
+}
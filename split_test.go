@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		html  bool
+		want  []string
+	}{
+		{"short text is kept", "привет", 10, false, []string{"привет"}},
+		{"line breaks are preferred", "first line\nsecond line", 15, false, []string{"first line", "second line"}},
+		{"then spaces", "one two three four", 10, false, []string{"one two", "three four"}},
+		{"a word without spaces is cut", "abcdefghij", 4, false, []string{"abcd", "efgh", "ij"}},
+		{"runes are counted, not bytes", "ааааа ббббб", 6, false, []string{"ааааа", "ббббб"}},
+		{"tags are closed and reopened", "<b>one two three</b>", 15, true, []string{"<b>one two </b>", "<b>three</b>"}},
+		{"entities are not broken", "a &amp; b &amp; c", 5, true, []string{"a &amp;", "b &amp; c"}},
+		{"tags are not counted as text in plain mode", "<b>one</b> two", 10, false, []string{"<b>one</b>", "two"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitMessage(tt.text, tt.limit, tt.html)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitMessage(%q, %d) = %q, want %q", tt.text, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMessageLimits(t *testing.T) {
+	line := "<b>Заявка</b> &amp; <i>описание " + strings.Repeat("слово ", 40) + "</i>\n"
+	text := strings.Repeat(line, 200)
+	parts := splitMessage(text, maxMessageLength, true)
+	if len(parts) < 2 {
+		t.Fatalf("%d parts", len(parts))
+	}
+	for idx, part := range parts {
+		size := 0
+		for _, token := range tokenizeHTML(part, true) {
+			size += token.size
+		}
+		if size > maxMessageLength {
+			t.Errorf("part %d: %d characters", idx, size)
+		}
+		if !isBalancedHTML(part) {
+			t.Errorf("part %d is not balanced", idx)
+		}
+		if !utf8.ValidString(part) {
+			t.Errorf("part %d is not valid UTF-8", idx)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Store - persistence used by handlers, notifier and sender
+type Store interface {
+	Ping() error
+
+	FindUsersByPhone(phones []string) ([]*User, error)
+	GetOrCreateUser(chatID int64, userID int, phone string, language string) (*User, error)
+	GetAdmins() ([]*User, error)
+	GetUserByChatID(chat int64) (*User, error)
+	GetUserByTGUser(userID int) (*User, error)
+	GetUsersByRedmineIDs(ids []int) ([]*User, error)
+	UpdateUserQuietHours(user *User, start string, end string, timezone string) error
+	UpdateUserLanguage(user *User, language string) error
+	MarkChatUnavailable(chat int64, reason string) error
+	ResetChatUnavailable(chat int64) error
+
+	GetOrCreateMessage(userID int, issueID int, status string, subject string, phone string, isAdmin bool, jsonMessage string) (*Message, error)
+
+	CreateDelivery(delivery *Delivery) error
+	SaveDelivery(delivery *Delivery) error
+	GetDelivery(id uint) (*Delivery, error)
+	GetDeliveryByTGMessage(chat int64, tgMessageID int, issueID int) (*Delivery, error)
+	GetDeliveries(issueID int, tgUsers []int, limit int) ([]*Delivery, error)
+	FinishOutboundDeliveries(outboundID uint, status string, tgMessageID int, reason string, at time.Time) error
+
+	GetPendingOutbound(chat int64, threadID int, issueID int, parseMode string) (*OutboundMessage, error)
+	GetDueOutbound(now time.Time) ([]*OutboundMessage, error)
+	SaveOutbound(message *OutboundMessage) error
+	MarkOutboundDelivered(message *OutboundMessage) error
+
+	CreateLongMessage(chat int64, threadID int, text string, parseMode string) (*LongMessage, error)
+	GetLongMessage(id int) (*LongMessage, error)
+
+	CreateWebhookEvent(issueID int, action string, journalID int, source string, correlationID string, payload string) (*WebhookEvent, error)
+	FindWebhookEvent(issueID int, action string, journalID int) (*WebhookEvent, error)
+	GetWebhookEvent(id uint) (*WebhookEvent, error)
+	GetPendingWebhookEvents() ([]*WebhookEvent, error)
+	CountPendingWebhookEvents() (int, error)
+	MarkWebhookEventProcessed(event *WebhookEvent, reason string) error
+
+	RegisterGroupChat(chat int64, title string, chatType string, language string) (*GroupChat, error)
+	GetGroupChat(chat int64) (*GroupChat, error)
+	CreateChatBinding(binding *ChatBinding) error
+	GetChatBindings() ([]*ChatBinding, error)
+	GetChatBindingsByChat(chat int64, threadID int) ([]*ChatBinding, error)
+	DeleteChatBindings(chat int64, threadID int) error
+
+	GetCheckpoint(name string) (*Checkpoint, error)
+	SaveCheckpoint(checkpoint *Checkpoint) error
+
+	SearchUsers(query string, limit int) ([]*User, error)
+	GetUser(id uint) (*User, error)
+	UpdateUserRole(user *User, isAdmin bool, redmineID int) error
+	GetMessage(id uint) (*Message, error)
+	GetFailedWebhookEvents(limit int) ([]*WebhookEvent, error)
+	GetRecentWebhookEvents(limit int) ([]*WebhookEvent, error)
+	ResetWebhookEvent(event *WebhookEvent) error
+}
+
+// ErrNotFound - the record doesn't exist, returned by Store lookups of a single record
+var ErrNotFound = errors.New("record not found")
+
+// notFound hides gorm behind Store: its missing record becomes ErrNotFound
+func notFound(err error) error {
+	if err == gorm.ErrRecordNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// DBStore - Store on top of the gorm helpers from db.go
+type DBStore struct {
+	db *gorm.DB
+}
+
+// NewDBStore ...
+func NewDBStore(db *gorm.DB) *DBStore {
+	return &DBStore{db: db}
+}
+
+func (s *DBStore) Ping() error {
+	return s.db.DB().Ping()
+}
+
+func (s *DBStore) FindUsersByPhone(phones []string) ([]*User, error) {
+	return FindUsersByPhone(s.db, phones)
+}
+
+func (s *DBStore) GetOrCreateUser(chatID int64, userID int, phone string, language string) (*User, error) {
+	return GetOrCreateUser(s.db, chatID, userID, phone, language)
+}
+
+func (s *DBStore) GetAdmins() ([]*User, error) {
+	return GetAdmins(s.db)
+}
+
+func (s *DBStore) GetUserByChatID(chat int64) (*User, error) {
+	user, err := GetUserByChatID(s.db, chat)
+	return user, notFound(err)
+}
+
+func (s *DBStore) GetUserByTGUser(userID int) (*User, error) {
+	user, err := GetUserByTGUser(s.db, userID)
+	return user, notFound(err)
+}
+
+func (s *DBStore) GetUsersByRedmineIDs(ids []int) ([]*User, error) {
+	return GetUsersByRedmineIDs(s.db, ids)
+}
+
+func (s *DBStore) UpdateUserQuietHours(user *User, start string, end string, timezone string) error {
+	return UpdateUserQuietHours(s.db, user, start, end, timezone)
+}
+
+func (s *DBStore) UpdateUserLanguage(user *User, language string) error {
+	return UpdateUserLanguage(s.db, user, language)
+}
+
+func (s *DBStore) MarkChatUnavailable(chat int64, reason string) error {
+	return MarkChatUnavailable(s.db, chat, reason)
+}
+
+func (s *DBStore) ResetChatUnavailable(chat int64) error {
+	return ResetChatUnavailable(s.db, chat)
+}
+
+func (s *DBStore) GetOrCreateMessage(userID int, issueID int, status string, subject string, phone string, isAdmin bool, jsonMessage string) (*Message, error) {
+	return GetOrCreateMessage(s.db, userID, issueID, status, subject, phone, isAdmin, jsonMessage)
+}
+
+func (s *DBStore) CreateDelivery(delivery *Delivery) error {
+	return CreateDelivery(s.db, delivery)
+}
+
+func (s *DBStore) SaveDelivery(delivery *Delivery) error {
+	return SaveDelivery(s.db, delivery)
+}
+
+func (s *DBStore) GetDelivery(id uint) (*Delivery, error) {
+	delivery, err := GetDelivery(s.db, id)
+	return delivery, notFound(err)
+}
+
+func (s *DBStore) GetDeliveryByTGMessage(chat int64, tgMessageID int, issueID int) (*Delivery, error) {
+	delivery, err := GetDeliveryByTGMessage(s.db, chat, tgMessageID, issueID)
+	return delivery, notFound(err)
+}
+
+func (s *DBStore) GetDeliveries(issueID int, tgUsers []int, limit int) ([]*Delivery, error) {
+	return GetDeliveries(s.db, issueID, tgUsers, limit)
+}
+
+func (s *DBStore) FinishOutboundDeliveries(outboundID uint, status string, tgMessageID int, reason string, at time.Time) error {
+	return FinishOutboundDeliveries(s.db, outboundID, status, tgMessageID, reason, at)
+}
+
+func (s *DBStore) GetPendingOutbound(chat int64, threadID int, issueID int, parseMode string) (*OutboundMessage, error) {
+	message, err := GetPendingOutbound(s.db, chat, threadID, issueID, parseMode)
+	return message, notFound(err)
+}
+
+func (s *DBStore) GetDueOutbound(now time.Time) ([]*OutboundMessage, error) {
+	return GetDueOutbound(s.db, now)
+}
+
+func (s *DBStore) SaveOutbound(message *OutboundMessage) error {
+	return SaveOutbound(s.db, message)
+}
+
+func (s *DBStore) MarkOutboundDelivered(message *OutboundMessage) error {
+	return MarkOutboundDelivered(s.db, message)
+}
+
+func (s *DBStore) CreateLongMessage(chat int64, threadID int, text string, parseMode string) (*LongMessage, error) {
+	return CreateLongMessage(s.db, chat, threadID, text, parseMode)
+}
+
+func (s *DBStore) GetLongMessage(id int) (*LongMessage, error) {
+	message, err := GetLongMessage(s.db, id)
+	return message, notFound(err)
+}
+
+func (s *DBStore) CreateWebhookEvent(issueID int, action string, journalID int, source string, correlationID string, payload string) (*WebhookEvent, error) {
+	return CreateWebhookEvent(s.db, issueID, action, journalID, source, correlationID, payload)
+}
+
+func (s *DBStore) FindWebhookEvent(issueID int, action string, journalID int) (*WebhookEvent, error) {
+	event, err := FindWebhookEvent(s.db, issueID, action, journalID)
+	return event, notFound(err)
+}
+
+func (s *DBStore) GetWebhookEvent(id uint) (*WebhookEvent, error) {
+	event, err := GetWebhookEvent(s.db, id)
+	return event, notFound(err)
+}
+
+func (s *DBStore) GetPendingWebhookEvents() ([]*WebhookEvent, error) {
+	return GetPendingWebhookEvents(s.db)
+}
+
+func (s *DBStore) CountPendingWebhookEvents() (int, error) {
+	return CountPendingWebhookEvents(s.db)
+}
+
+func (s *DBStore) MarkWebhookEventProcessed(event *WebhookEvent, reason string) error {
+	return MarkWebhookEventProcessed(s.db, event, reason)
+}
+
+func (s *DBStore) RegisterGroupChat(chat int64, title string, chatType string, language string) (*GroupChat, error) {
+	return RegisterGroupChat(s.db, chat, title, chatType, language)
+}
+
+func (s *DBStore) GetGroupChat(chat int64) (*GroupChat, error) {
+	group, err := GetGroupChat(s.db, chat)
+	return group, notFound(err)
+}
+
+func (s *DBStore) CreateChatBinding(binding *ChatBinding) error {
+	return CreateChatBinding(s.db, binding)
+}
+
+func (s *DBStore) GetChatBindings() ([]*ChatBinding, error) {
+	return GetChatBindings(s.db)
+}
+
+func (s *DBStore) GetChatBindingsByChat(chat int64, threadID int) ([]*ChatBinding, error) {
+	return GetChatBindingsByChat(s.db, chat, threadID)
+}
+
+func (s *DBStore) DeleteChatBindings(chat int64, threadID int) error {
+	return DeleteChatBindings(s.db, chat, threadID)
+}
+
+func (s *DBStore) GetCheckpoint(name string) (*Checkpoint, error) {
+	checkpoint, err := GetCheckpoint(s.db, name)
+	return checkpoint, notFound(err)
+}
+
+func (s *DBStore) SaveCheckpoint(checkpoint *Checkpoint) error {
+	return SaveCheckpoint(s.db, checkpoint)
+}
+
+func (s *DBStore) SearchUsers(query string, limit int) ([]*User, error) {
+	return SearchUsers(s.db, query, limit)
+}
+
+func (s *DBStore) GetUser(id uint) (*User, error) {
+	user, err := GetUser(s.db, id)
+	return user, notFound(err)
+}
+
+func (s *DBStore) UpdateUserRole(user *User, isAdmin bool, redmineID int) error {
+	return UpdateUserRole(s.db, user, isAdmin, redmineID)
+}
+
+func (s *DBStore) GetMessage(id uint) (*Message, error) {
+	message, err := GetMessage(s.db, id)
+	return message, notFound(err)
+}
+
+func (s *DBStore) GetFailedWebhookEvents(limit int) ([]*WebhookEvent, error) {
+	return GetFailedWebhookEvents(s.db, limit)
+}
+
+func (s *DBStore) GetRecentWebhookEvents(limit int) ([]*WebhookEvent, error) {
+	return GetRecentWebhookEvents(s.db, limit)
+}
+
+func (s *DBStore) ResetWebhookEvent(event *WebhookEvent) error {
+	return ResetWebhookEvent(s.db, event)
+}
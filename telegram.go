@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/labstack/echo"
+)
+
+// tgbotapi v4 predates forum topics, message_thread_id is read and sent here.
+
+// TelegramUpdate - tgbotapi.Update with the forum topic of its message
+type TelegramUpdate struct {
+	tgbotapi.Update
+	ThreadID int
+}
+
+type threadMessage struct {
+	ThreadID int `json:"message_thread_id"`
+}
+
+func decodeUpdate(raw []byte) (update TelegramUpdate, err error) {
+	if err = json.Unmarshal(raw, &update.Update); err != nil {
+		return update, err
+	}
+	var extra struct {
+		Message       *threadMessage `json:"message"`
+		CallbackQuery *struct {
+			Message *threadMessage `json:"message"`
+		} `json:"callback_query"`
+	}
+	if err = json.Unmarshal(raw, &extra); err != nil {
+		return update, err
+	}
+	switch {
+	case extra.Message != nil:
+		update.ThreadID = extra.Message.ThreadID
+	case extra.CallbackQuery != nil && extra.CallbackQuery.Message != nil:
+		update.ThreadID = extra.CallbackQuery.Message.ThreadID
+	}
+	return update, nil
+}
+
+// UpdateSource - where Telegram updates come from: UpdatePoller or TelegramWebhook
+type UpdateSource interface {
+	Updates() <-chan TelegramUpdate
+	Run()
+	Stop()
+}
+
+// UpdatePoller - getUpdates long polling, replaces BotAPI.GetUpdatesChan
+type UpdatePoller struct {
+	bot       *tgbotapi.BotAPI
+	timeout   int
+	updates   chan TelegramUpdate
+	closeChan chan interface{}
+}
+
+// NewUpdatePoller ...
+func NewUpdatePoller(bot *tgbotapi.BotAPI, timeout int) *UpdatePoller {
+	return &UpdatePoller{
+		bot:       bot,
+		timeout:   timeout,
+		updates:   make(chan TelegramUpdate, bot.Buffer),
+		closeChan: make(chan interface{}),
+	}
+}
+
+// Updates ...
+func (p *UpdatePoller) Updates() <-chan TelegramUpdate {
+	return p.updates
+}
+
+// Run ...
+func (p *UpdatePoller) Run() {
+	offset := 0
+	for {
+		select {
+		case <-p.closeChan:
+			close(p.updates)
+			return
+		default:
+		}
+
+		params := url.Values{}
+		params.Add("offset", strconv.Itoa(offset))
+		params.Add("timeout", strconv.Itoa(p.timeout))
+		resp, err := p.bot.MakeRequest("getUpdates", params)
+		var raw []json.RawMessage
+		if err == nil {
+			err = json.Unmarshal(resp.Result, &raw)
+		}
+		if err != nil {
+			logger.Warn("getting updates failed, retrying in 3 seconds", "err", err)
+			time.Sleep(3 * time.Second)
+			continue
+		}
+
+		for _, item := range raw {
+			update, err := decodeUpdate(item)
+			if err != nil {
+				logger.Warn("bad update", "err", err)
+				continue
+			}
+			if update.UpdateID >= offset {
+				offset = update.UpdateID + 1
+				p.updates <- update
+			}
+		}
+	}
+}
+
+// Stop ...
+func (p *UpdatePoller) Stop() {
+	close(p.closeChan)
+}
+
+// TelegramWebhook - updates pushed by Telegram to a path of the echo server.
+// Run registers the webhook, Stop removes it.
+type TelegramWebhook struct {
+	bot     *tgbotapi.BotAPI
+	config  TelegramConfig
+	updates chan TelegramUpdate
+
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// NewTelegramWebhook ...
+func NewTelegramWebhook(bot *tgbotapi.BotAPI, config TelegramConfig) *TelegramWebhook {
+	return &TelegramWebhook{
+		bot:     bot,
+		config:  config,
+		updates: make(chan TelegramUpdate, bot.Buffer),
+	}
+}
+
+// Updates ...
+func (w *TelegramWebhook) Updates() <-chan TelegramUpdate {
+	return w.updates
+}
+
+// Run registers the webhook, with the self-signed certificate if it is configured.
+// The bot exits if Telegram refuses it.
+func (w *TelegramWebhook) Run() {
+	var (
+		resp tgbotapi.APIResponse
+		err  error
+	)
+	if w.config.Certificate != "" {
+		params := map[string]string{"url": w.config.WebhookURL, "secret_token": w.config.SecretToken}
+		resp, err = w.bot.UploadFile("setWebhook", params, "certificate", w.config.Certificate)
+	} else {
+		params := url.Values{}
+		params.Add("url", w.config.WebhookURL)
+		params.Add("secret_token", w.config.SecretToken)
+		resp, err = w.bot.MakeRequest("setWebhook", params)
+	}
+	if err != nil {
+		// Without the webhook the bot gets no updates at all
+		logger.Fatal("setting telegram webhook failed", "err", err)
+	}
+	logger.Info("telegram webhook is set", "url", w.config.WebhookURL, "description", resp.Description)
+}
+
+// Stop removes the webhook, updates arriving after that are refused
+// and redelivered by Telegram to the next instance
+func (w *TelegramWebhook) Stop() {
+	if _, err := w.bot.MakeRequest("deleteWebhook", url.Values{}); err != nil {
+		logger.Error("deleting telegram webhook failed", "err", err)
+	}
+	w.mu.Lock()
+	w.stopped = true
+	close(w.updates)
+	w.mu.Unlock()
+}
+
+// Handle - echo handler for updates posted by Telegram
+func (w *TelegramWebhook) Handle(c echo.Context) error {
+	token := c.Request().Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(w.config.SecretToken)) != 1 {
+		return c.NoContent(http.StatusUnauthorized)
+	}
+	raw, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	update, err := decodeUpdate(raw)
+	if err != nil {
+		logger.Warn("bad update", "err", err)
+		// Telegram would retry a malformed update forever
+		return c.NoContent(http.StatusOK)
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.stopped {
+		return c.NoContent(http.StatusServiceUnavailable)
+	}
+	w.updates <- update
+	return c.NoContent(http.StatusOK)
+}
+
+// ThreadMessage - message to a forum topic. It is sent by Sender,
+// BotAPI.Send would drop the topic.
+type ThreadMessage struct {
+	tgbotapi.MessageConfig
+	ThreadID int
+}
+
+// withThread wraps message for a forum topic, threadID 0 is the chat itself
+func withThread(message tgbotapi.MessageConfig, threadID int) tgbotapi.Chattable {
+	if threadID == 0 {
+		return message
+	}
+	return ThreadMessage{MessageConfig: message, ThreadID: threadID}
+}
+
+// sendThreadMessage sends message with message_thread_id through MakeRequest
+func sendThreadMessage(bot Messenger, message ThreadMessage) (tgbotapi.Message, error) {
+	params := url.Values{}
+	params.Add("chat_id", strconv.FormatInt(message.ChatID, 10))
+	params.Add("message_thread_id", strconv.Itoa(message.ThreadID))
+	params.Add("text", message.Text)
+	params.Add("disable_web_page_preview", strconv.FormatBool(message.DisableWebPagePreview))
+	params.Add("disable_notification", strconv.FormatBool(message.DisableNotification))
+	if message.ParseMode != "" {
+		params.Add("parse_mode", message.ParseMode)
+	}
+	if message.ReplyMarkup != nil {
+		markup, err := json.Marshal(message.ReplyMarkup)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		params.Add("reply_markup", string(markup))
+	}
+
+	resp, err := bot.MakeRequest("sendMessage", params)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	var sent tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &sent)
+	return sent, err
+}
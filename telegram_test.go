@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestTelegramWebhookSecret(t *testing.T) {
+	const update = `{"update_id": 7, "message": {"message_id": 1, "message_thread_id": 42, "chat": {"id": -1001, "type": "supergroup"}, "text": "/bindings"}}`
+	tests := []struct {
+		name    string
+		token   string
+		body    string
+		stopped bool
+		status  int
+		queued  bool
+	}{
+		{"no token", "", update, false, http.StatusUnauthorized, false},
+		{"wrong token", "guess", update, false, http.StatusUnauthorized, false},
+		{"prefix of the token", "s3cr", update, false, http.StatusUnauthorized, false},
+		{"valid update", "s3cret", update, false, http.StatusOK, true},
+		{"malformed update is acknowledged", "s3cret", "{", false, http.StatusOK, false},
+		{"stopped", "s3cret", update, true, http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhook := &TelegramWebhook{
+				config:  TelegramConfig{SecretToken: "s3cret"},
+				updates: make(chan TelegramUpdate, 1),
+				stopped: tt.stopped,
+			}
+			request := httptest.NewRequest(http.MethodPost, "/telegram", strings.NewReader(tt.body))
+			if tt.token != "" {
+				request.Header.Set("X-Telegram-Bot-Api-Secret-Token", tt.token)
+			}
+			recorder := httptest.NewRecorder()
+			if err := webhook.Handle(echo.New().NewContext(request, recorder)); err != nil {
+				t.Fatal(err)
+			}
+			if recorder.Code != tt.status {
+				t.Errorf("status %d, want %d", recorder.Code, tt.status)
+			}
+			if queued := len(webhook.updates) == 1; queued != tt.queued {
+				t.Fatalf("queued %v, want %v", queued, tt.queued)
+			}
+			if tt.queued {
+				got := <-webhook.updates
+				if got.UpdateID != 7 || got.ThreadID != 42 {
+					t.Errorf("update %d in thread %d", got.UpdateID, got.ThreadID)
+				}
+			}
+		})
+	}
+}
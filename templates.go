@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Names of registered templates
+const (
+	staffTemplate  = "staff"
+	clientTemplate = "client"
+)
+
+// How often template files are checked for changes
+const templateWatchInterval = 2 * time.Second
+
+type storedTemplate struct {
+	path     string
+	sample   interface{}
+	tmpl     *template.Template
+	modified time.Time
+}
+
+// TemplateStore - parsed templates reloaded from disk when the files change.
+// A template that fails to parse or execute keeps its last good version.
+type TemplateStore struct {
+	config    Config
+	mu        sync.RWMutex
+	templates map[string]*storedTemplate
+	closeChan chan interface{}
+	closeOnce sync.Once
+}
+
+// NewTemplateStore ...
+func NewTemplateStore(config Config) *TemplateStore {
+	return &TemplateStore{
+		config:    config,
+		templates: make(map[string]*storedTemplate),
+		closeChan: make(chan interface{}),
+	}
+}
+
+// parseTemplate parses the file and executes it against sample data,
+// so that unknown fields and functions are caught before the first send
+func (ts *TemplateStore) parseTemplate(path string, sample interface{}) (*template.Template, error) {
+	tmpl, err := template.New(filepath.Base(path)).
+		Funcs(templateFuncs(ts.config)).
+		ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var t bytes.Buffer
+	if err := tmpl.Execute(&t, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Register loads template from path under name, sample is a zero value of its data
+func (ts *TemplateStore) Register(name string, path string, sample interface{}) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmpl, err := ts.parseTemplate(path, sample)
+	if err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.templates[name] = &storedTemplate{
+		path:     path,
+		sample:   sample,
+		tmpl:     tmpl,
+		modified: info.ModTime(),
+	}
+	return nil
+}
+
+// Render executes the template registered under name
+func (ts *TemplateStore) Render(name string, data interface{}) (string, error) {
+	ts.mu.RLock()
+	stored, ok := ts.templates[name]
+	ts.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("template %q is not registered", name)
+	}
+
+	var t bytes.Buffer
+	if err := stored.tmpl.Execute(&t, data); err != nil {
+		return "", err
+	}
+	return t.String(), nil
+}
+
+// RenderLocalized executes "<name>.<lang>" template, falling back to name
+func (ts *TemplateStore) RenderLocalized(name string, lang string, data interface{}) (string, error) {
+	ts.mu.RLock()
+	_, ok := ts.templates[name+"."+lang]
+	ts.mu.RUnlock()
+	if ok {
+		name = name + "." + lang
+	}
+	return ts.Render(name, data)
+}
+
+func (ts *TemplateStore) reload() {
+	ts.mu.RLock()
+	var changed []string
+	for name, stored := range ts.templates {
+		info, err := os.Stat(stored.path)
+		if err != nil {
+			logger.Error("template reload failed", "path", stored.path, "err", err)
+			continue
+		}
+		if info.ModTime() != stored.modified {
+			changed = append(changed, name)
+		}
+	}
+	ts.mu.RUnlock()
+
+	for _, name := range changed {
+		ts.mu.RLock()
+		stored := *ts.templates[name]
+		ts.mu.RUnlock()
+
+		info, err := os.Stat(stored.path)
+		if err != nil {
+			continue
+		}
+		tmpl, err := ts.parseTemplate(stored.path, stored.sample)
+		// Render uses the stored template without the lock, so it is replaced, never changed
+		stored.modified = info.ModTime()
+		if err != nil {
+			logger.Error("template is invalid, keeping previous version", "path", stored.path, "err", err)
+		} else {
+			stored.tmpl = tmpl
+			logger.Info("template reloaded", "path", stored.path)
+		}
+		ts.mu.Lock()
+		ts.templates[name] = &stored
+		ts.mu.Unlock()
+	}
+}
+
+// localizedPath turns notification.tmpl into notification.<lang>.tmpl
+func localizedPath(path string, lang string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + lang + ext
+}
+
+// loadTemplates registers staff and client templates from config. Templates
+// for other languages are optional files next to them, see localizedPath.
+func loadTemplates(config Config, languages []string) (*TemplateStore, error) {
+	templates := NewTemplateStore(config)
+	files := map[string]string{
+		staffTemplate:  config.NotificationTemplate,
+		clientTemplate: config.ClientNotificationTemplate,
+	}
+	samples := map[string]interface{}{
+		staffTemplate:  &TemplateData{},
+		clientTemplate: ClientTemplateData{},
+	}
+	for name, path := range files {
+		if err := templates.Register(name, path, samples[name]); err != nil {
+			return nil, err
+		}
+		for _, lang := range languages {
+			localized := localizedPath(path, lang)
+			if _, err := os.Stat(localized); err != nil {
+				continue
+			}
+			if err := templates.Register(name+"."+lang, localized, samples[name]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return templates, nil
+}
+
+// Watch ...
+func (ts *TemplateStore) Watch() {
+	ticker := time.NewTicker(templateWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ts.reload()
+		case <-ts.closeChan:
+			return
+		}
+	}
+}
+
+// Stop ...
+func (ts *TemplateStore) Stop() {
+	ts.closeOnce.Do(func() { close(ts.closeChan) })
+}
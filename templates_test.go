@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type templateSample struct {
+	Name string
+}
+
+// writeTemplate writes text to path with a modification time different from the previous one
+func writeTemplate(t *testing.T, path string, text string, modified time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notification.tmpl")
+	started := time.Now().Add(-time.Hour)
+	writeTemplate(t, path, "Привет, {{.Name}}", started)
+
+	ts := NewTemplateStore(Config{})
+	if err := ts.Register(staffTemplate, path, templateSample{}); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"registered", "", "Привет, Иван"},
+		{"changed file is reloaded", "Здравствуйте, {{.Name}}", "Здравствуйте, Иван"},
+		{"syntax error keeps the previous version", "{{.Name", "Здравствуйте, Иван"},
+		{"unknown field keeps the previous version", "{{.Phone}}", "Здравствуйте, Иван"},
+		{"fixed file is reloaded", "Добрый день, {{.Name}}", "Добрый день, Иван"},
+	}
+	for idx, step := range steps {
+		if step.text != "" {
+			writeTemplate(t, path, step.text, started.Add(time.Duration(idx)*time.Minute))
+			ts.reload()
+		}
+		got, err := ts.Render(staffTemplate, templateSample{Name: "Иван"})
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got != step.want {
+			t.Errorf("%s: %q, want %q", step.name, got, step.want)
+		}
+	}
+}
+
+// TestTemplateReloadRace renders while the template is reloaded, run with -race
+func TestTemplateReloadRace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notification.tmpl")
+	started := time.Now().Add(-time.Hour)
+	writeTemplate(t, path, "{{.Name}}", started)
+	ts := NewTemplateStore(Config{})
+	if err := ts.Register(staffTemplate, path, templateSample{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := ts.Render(staffTemplate, templateSample{Name: "x"}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 20; i++ {
+		writeTemplate(t, path, "{{.Name}} v2", started.Add(time.Duration(i)*time.Second))
+		ts.reload()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestRenderLocalized(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notification.tmpl")
+	writeTemplate(t, path, "Привет", time.Now())
+	writeTemplate(t, localizedPath(path, "en"), "Hello", time.Now())
+	config := Config{NotificationTemplate: path, ClientNotificationTemplate: path}
+	ts, err := loadTemplates(config, []string{"ru", "en", "de"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for lang, want := range map[string]string{"en": "Hello", "ru": "Привет", "de": "Привет"} {
+		got, err := ts.RenderLocalized(staffTemplate, lang, &TemplateData{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: %q, want %q", lang, got, want)
+		}
+	}
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"fmt"
-	"html/template"
 	"net/http"
 	"net/url"
+	"text/template"
 )
 
 func getProxyClient(scheme string, host string, port int, user string, pass string) *http.Client {
@@ -24,10 +24,27 @@ func getProxyClient(scheme string, host string, port int, user string, pass stri
 	return httpClient
 }
 
-func getTemplate(config Config) (*template.Template, error) {
-	tmpl, err := template.ParseFiles(config.NotificationTemplate)
-	if err != nil {
-		return nil, err
+// templateFuncs - helpers for templates sent with ParseMode "html".
+// Templates are rendered with text/template, so Redmine values must go
+// through escape or markup explicitly.
+func templateFuncs(config Config) template.FuncMap {
+	issueURL := func(id int) string {
+		return fmt.Sprintf("%sissues/%d", config.RedmineHost, id)
+	}
+	return template.FuncMap{
+		"escape":   escapeHTML,
+		"truncate": truncateText,
+		"date":     formatDate,
+		"link":     htmlLink,
+		"issueURL": issueURL,
+		"issueLink": func(id int) string {
+			return htmlLink(issueURL(id), fmt.Sprintf("#%d", id))
+		},
+		"userLink": func(id int, name string) string {
+			return htmlLink(fmt.Sprintf("%susers/%d", config.RedmineHost, id), name)
+		},
+		"markup": func(text string) string {
+			return markupToHTML(config.TextFormatting, text)
+		},
 	}
-	return tmpl, nil
 }